@@ -0,0 +1,368 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const archiveVersion = 1
+
+type archiveManifest struct {
+	Version        int              `json:"version"`
+	CreatedAt      time.Time        `json:"created_at"`
+	SnapshotID     string           `json:"snapshot_id"`
+	Steps          []*archiveStep   `json:"steps"`
+	SequenceValues []*sequenceValue `json:"sequence_values"`
+}
+
+type archiveStep struct {
+	TableName     string   `json:"table_name"`
+	CopyFromSQL   string   `json:"copy_from_sql"`
+	BeforeCopySQL string   `json:"before_copy_sql,omitempty"`
+	AfterCopySQL  string   `json:"after_copy_sql,omitempty"`
+	Files         []string `json:"files"`
+
+	chunkFiles map[int]string
+}
+
+const (
+	archiveManifestName    = "manifest.json"
+	archivePreDataSQLName  = "pre-data.sql"
+	archivePostDataSQLName = "post-data.sql"
+)
+
+type stepFiles struct {
+	tempDir string
+	mux     sync.Mutex
+	steps   map[int]*archiveStep
+}
+
+func newStepFiles(dir string) (*stepFiles, error) {
+	tempDir, err := os.MkdirTemp(dir, ".pg_partialcopy-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary directory: %w", err)
+	}
+
+	return &stepFiles{tempDir: tempDir, steps: make(map[int]*archiveStep)}, nil
+}
+
+func (sf *stepFiles) write(task stepTask, step *Step, plan *stepCopyPlan, write func(w io.Writer) error) error {
+	name := fmt.Sprintf("data/%d.copy", task.stepIdx)
+	if task.chunkIdx >= 0 {
+		name = fmt.Sprintf("data/%d.%d.copy", task.stepIdx, task.chunkIdx)
+	}
+
+	err := writeFile(sf.filePath(name), write)
+	if err != nil {
+		return err
+	}
+
+	sf.mux.Lock()
+	defer sf.mux.Unlock()
+	as := sf.steps[task.stepIdx]
+	if as == nil {
+		as = &archiveStep{
+			TableName:     step.TableName,
+			CopyFromSQL:   plan.CopyFromSQL,
+			BeforeCopySQL: step.BeforeCopySQL,
+			AfterCopySQL:  step.AfterCopySQL,
+			chunkFiles:    make(map[int]string),
+		}
+		sf.steps[task.stepIdx] = as
+	}
+	as.chunkFiles[task.chunkIdx] = name
+
+	return nil
+}
+
+func (sf *stepFiles) sortedSteps() []*archiveStep {
+	var steps []*archiveStep
+	for _, stepIdx := range slices.Sorted(maps.Keys(sf.steps)) {
+		as := sf.steps[stepIdx]
+		as.Files = nil
+		for _, chunkIdx := range slices.Sorted(maps.Keys(as.chunkFiles)) {
+			as.Files = append(as.Files, as.chunkFiles[chunkIdx])
+		}
+		steps = append(steps, as)
+	}
+	return steps
+}
+
+func (sf *stepFiles) filePath(name string) string {
+	return filepath.Join(sf.tempDir, filepath.FromSlash(name))
+}
+
+func (sf *stepFiles) cleanup() error {
+	return os.RemoveAll(sf.tempDir)
+}
+
+type archiveOutput struct {
+	*stepFiles
+
+	path string
+}
+
+func newArchiveOutput(path string) (*archiveOutput, error) {
+	sf, err := newStepFiles(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+
+	return &archiveOutput{stepFiles: sf, path: path}, nil
+}
+
+func (o *archiveOutput) writeStep(ctx context.Context, sourceConn *pgconn.PgConn, task stepTask, step *Step, plan *stepCopyPlan) error {
+	return o.write(task, step, plan, func(w io.Writer) error {
+		_, err := writeRows(ctx, sourceConn, w, plan)
+		return err
+	})
+}
+
+func (o *archiveOutput) finish(structure *sourceStructure) error {
+	manifest := &archiveManifest{
+		Version:        archiveVersion,
+		CreatedAt:      time.Now(),
+		SnapshotID:     structure.SnapshotID,
+		Steps:          o.sortedSteps(),
+		SequenceValues: structure.SequenceValues,
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding manifest: %w", err)
+	}
+
+	err = writeFile(o.path, func(w io.Writer) error {
+		gw := gzip.NewWriter(w)
+		tw := tar.NewWriter(gw)
+
+		files := []struct {
+			name string
+			data []byte
+		}{
+			{archiveManifestName, manifestJSON},
+			{archivePreDataSQLName, structure.PreDataSQL},
+			{archivePostDataSQLName, structure.PostDataSQL},
+		}
+		for _, f := range files {
+			err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.data)), ModTime: manifest.CreatedAt})
+			if err != nil {
+				return err
+			}
+			_, err = tw.Write(f.data)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, as := range manifest.Steps {
+			for _, name := range as.Files {
+				err := addFileToTar(tw, o.filePath(name), name)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		err := tw.Close()
+		if err != nil {
+			return err
+		}
+		return gw.Close()
+	})
+	if err != nil {
+		return fmt.Errorf("error writing archive: %w", err)
+	}
+	slog.Info("Wrote archive", "path", o.path)
+
+	return nil
+}
+
+func addFileToTar(tw *tar.Writer, path, name string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: fi.Size(), ModTime: fi.ModTime()})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+func writeFile(path string, write func(w io.Writer) error) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	err = write(file)
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	return err
+}
+
+func restoreArchive(ctx context.Context, archivePath string, config *Config) error {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("error opening archive: %w", err)
+	}
+	defer file.Close()
+
+	gr, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("error reading archive: %w", err)
+	}
+	tr := tar.NewReader(gr)
+
+	nextFile := func(name string) error {
+		header, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return fmt.Errorf("error reading archive: %s is missing", name)
+			}
+			return fmt.Errorf("error reading archive: %w", err)
+		}
+		if header.Name != name {
+			return fmt.Errorf("error reading archive: expected %s, got %s", name, header.Name)
+		}
+		return nil
+	}
+
+	err = nextFile(archiveManifestName)
+	if err != nil {
+		return err
+	}
+	var manifest archiveManifest
+	err = json.NewDecoder(tr).Decode(&manifest)
+	if err != nil {
+		return fmt.Errorf("error decoding manifest: %w", err)
+	}
+	if manifest.Version != archiveVersion {
+		return fmt.Errorf("unsupported archive version: %d", manifest.Version)
+	}
+	slog.Info("Read archive manifest", "snapshot_id", manifest.SnapshotID, "created_at", manifest.CreatedAt)
+
+	err = nextFile(archivePreDataSQLName)
+	if err != nil {
+		return err
+	}
+	preDataSQL, err := io.ReadAll(tr)
+	if err != nil {
+		return fmt.Errorf("error reading archive: %w", err)
+	}
+
+	err = nextFile(archivePostDataSQLName)
+	if err != nil {
+		return err
+	}
+	postDataSQL, err := io.ReadAll(tr)
+	if err != nil {
+		return fmt.Errorf("error reading archive: %w", err)
+	}
+
+	err = prepareDestination(config.Destination)
+	if err != nil {
+		return fmt.Errorf("error preparing destination: %w", err)
+	}
+
+	err = loadStructureToDestination(config.Destination.DatabaseURL, preDataSQL)
+	if err != nil {
+		return fmt.Errorf("error loading structure to destination: %w", err)
+	}
+	slog.Info("Loaded pre-data structure to destination")
+
+	destinationConn, err := pgconn.Connect(ctx, config.Destination.DatabaseURL)
+	if err != nil {
+		return fmt.Errorf("error connecting to destination database: %w", err)
+	}
+	defer destinationConn.Close(ctx)
+
+	err = setSequenceValues(ctx, destinationConn, manifest.SequenceValues, false)
+	if err != nil {
+		return fmt.Errorf("error setting sequence values: %w", err)
+	}
+	slog.Info("Set sequence values")
+
+	for i, as := range manifest.Steps {
+		err := restoreArchiveStep(ctx, destinationConn, as, func(name string) (io.Reader, error) {
+			err := nextFile(name)
+			if err != nil {
+				return nil, err
+			}
+			return tr, nil
+		})
+		if err != nil {
+			return fmt.Errorf("error restoring step %d (%s): %w", i, as.TableName, err)
+		}
+		slog.Info("Restored step", "idx", i, "table_name", as.TableName)
+	}
+
+	err = loadPostData(ctx, config, postDataSQL)
+	if err != nil {
+		return fmt.Errorf("error loading post-data structure to destination: %w", err)
+	}
+	slog.Info("Loaded post-data structure to destination")
+
+	return nil
+}
+
+func restoreArchiveStep(ctx context.Context, conn *pgconn.PgConn, as *archiveStep, openFile func(name string) (io.Reader, error)) error {
+	if as.BeforeCopySQL != "" {
+		err := conn.Exec(ctx, as.BeforeCopySQL).Close()
+		if err != nil {
+			return fmt.Errorf("error executing before copy SQL: %w", err)
+		}
+	}
+
+	for _, name := range as.Files {
+		r, err := openFile(name)
+		if err != nil {
+			return err
+		}
+		_, err = conn.CopyFrom(ctx, r, as.CopyFromSQL)
+		if err != nil {
+			return fmt.Errorf("error copying %s: %w", name, err)
+		}
+	}
+
+	if as.AfterCopySQL != "" {
+		err := conn.Exec(ctx, as.AfterCopySQL).Close()
+		if err != nil {
+			return fmt.Errorf("error executing after copy SQL: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	checkpointStepStarted   = "started"
+	checkpointStepCompleted = "completed"
+)
+
+type checkpoint struct {
+	SnapshotID string `json:"snapshot_id"`
+
+	// If SourceSnapshot is unchanged on resume, no transaction that could have modified the source has started since.
+	SourceSnapshot      string            `json:"source_snapshot"`
+	StructureHash       string            `json:"structure_hash"`
+	RecreateForeignKeys []*foreignKey     `json:"recreate_foreign_keys,omitempty"`
+	Steps               []*checkpointStep `json:"steps"`
+
+	path string
+	mux  sync.Mutex
+}
+
+type checkpointStep struct {
+	TableName string `json:"table_name"`
+	Status    string `json:"status"`
+}
+
+func newCheckpoint(path string, steps []*Step) *checkpoint {
+	cp := &checkpoint{path: path, Steps: make([]*checkpointStep, len(steps))}
+	for i, step := range steps {
+		cp.Steps[i] = &checkpointStep{TableName: step.TableName}
+	}
+	return cp
+}
+
+func readCheckpoint(path string) (*checkpoint, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading checkpoint file: %w", err)
+	}
+
+	cp := &checkpoint{path: path}
+	err = json.Unmarshal(buf, cp)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding checkpoint file: %w", err)
+	}
+
+	return cp, nil
+}
+
+func (cp *checkpoint) checkSteps(steps []*Step) error {
+	if len(steps) != len(cp.Steps) {
+		return fmt.Errorf("checkpoint has %d steps but config has %d", len(cp.Steps), len(steps))
+	}
+	for i, step := range steps {
+		if step.TableName != cp.Steps[i].TableName {
+			return fmt.Errorf("checkpoint step %d is %s but config step is %s", i, cp.Steps[i].TableName, step.TableName)
+		}
+	}
+	return nil
+}
+
+func (cp *checkpoint) stepStatus(idx int) string {
+	cp.mux.Lock()
+	defer cp.mux.Unlock()
+	return cp.Steps[idx].Status
+}
+
+func (cp *checkpoint) setStepStatus(idx int, status string) error {
+	cp.mux.Lock()
+	defer cp.mux.Unlock()
+	cp.Steps[idx].Status = status
+	return cp.saveLocked()
+}
+
+func (cp *checkpoint) save() error {
+	cp.mux.Lock()
+	defer cp.mux.Unlock()
+	return cp.saveLocked()
+}
+
+func (cp *checkpoint) saveLocked() error {
+	buf, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding checkpoint: %w", err)
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(cp.path), filepath.Base(cp.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating checkpoint file: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(buf)
+	if err == nil {
+		err = tmpFile.Close()
+	} else {
+		tmpFile.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("error writing checkpoint file: %w", err)
+	}
+
+	err = os.Rename(tmpFile.Name(), cp.path)
+	if err != nil {
+		return fmt.Errorf("error writing checkpoint file: %w", err)
+	}
+
+	return nil
+}
+
+func (cp *checkpoint) remove() error {
+	err := os.Remove(cp.path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing checkpoint file: %w", err)
+	}
+	return nil
+}
+
+func hashStructureSQL(structureSQL []byte) string {
+	h := sha256.New()
+	for line := range bytes.Lines(structureSQL) {
+		if bytes.HasPrefix(line, []byte(`\restrict `)) || bytes.HasPrefix(line, []byte(`\unrestrict `)) {
+			continue
+		}
+		h.Write(line)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func (step *Step) validateChunking() error {
+	if step.ChunkBy == "" {
+		return nil
+	}
+
+	switch step.ChunkBy {
+	case "primary_key":
+	case "ctid":
+		if step.SelectSQL != "" || step.Where != "" {
+			return fmt.Errorf("chunk_by ctid cannot be used with select_sql or where")
+		}
+	default:
+		return fmt.Errorf("unknown chunk_by: %s", step.ChunkBy)
+	}
+
+	if step.ChunkSize <= 0 {
+		return fmt.Errorf("chunk_size must be greater than 0")
+	}
+	if step.BeforeCopySQL != "" || step.AfterCopySQL != "" {
+		return fmt.Errorf("before_copy_sql and after_copy_sql cannot be used with chunk_by")
+	}
+
+	return nil
+}
+
+func planChunks(ctx context.Context, conn *pgconn.PgConn, step *Step) ([]*Step, error) {
+	err := step.validateChunking()
+	if err != nil {
+		return nil, err
+	}
+
+	tableName, err := resolveTableName(ctx, conn, step.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if tableName == "" {
+		return nil, fmt.Errorf("table %s does not exist in source", step.TableName)
+	}
+
+	var column string
+	var bounds []int64
+	switch step.ChunkBy {
+	case "primary_key":
+		result := conn.ExecParams(ctx, `select a.attname, a.atttypid::regtype::text
+from pg_index i
+  join pg_attribute a on a.attrelid = i.indrelid and a.attnum = i.indkey[0]
+where i.indrelid = $1::regclass
+  and i.indisprimary
+  and i.indnkeyatts = 1`, [][]byte{[]byte(tableName)}, nil, nil, nil).Read()
+		if result.Err != nil {
+			return nil, fmt.Errorf("error getting primary key of %s: %w", tableName, result.Err)
+		}
+		if len(result.Rows) == 0 {
+			return nil, fmt.Errorf("chunk_by primary_key requires %s to have a single column primary key", tableName)
+		}
+		switch string(result.Rows[0][1]) {
+		case "smallint", "integer", "bigint":
+		default:
+			return nil, fmt.Errorf("chunk_by primary_key requires the primary key of %s to be an integer", tableName)
+		}
+		column = pgx.Identifier{string(result.Rows[0][0])}.Sanitize()
+
+		result = conn.ExecParams(ctx, fmt.Sprintf("select min(%s) from %s", column, tableName), nil, nil, nil, nil).Read()
+		if result.Err != nil {
+			return nil, fmt.Errorf("error getting primary key range of %s: %w", tableName, result.Err)
+		}
+		bound := result.Rows[0][0]
+
+		// The next bound is the primary key of the row chunk_size rows after the current bound.
+		nextBoundSQL := fmt.Sprintf("select %s from %s where %s >= $1 order by %s offset %d limit 1", column, tableName, column, column, step.ChunkSize)
+		for bound != nil {
+			result := conn.ExecParams(ctx, nextBoundSQL, [][]byte{bound}, nil, nil, nil).Read()
+			if result.Err != nil {
+				return nil, fmt.Errorf("error getting primary key range of %s: %w", tableName, result.Err)
+			}
+			if len(result.Rows) == 0 {
+				break
+			}
+			bound = result.Rows[0][0]
+			n, err := strconv.ParseInt(string(bound), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			bounds = append(bounds, n)
+		}
+	case "ctid":
+		result := conn.ExecParams(ctx,
+			"select pg_relation_size($1::regclass) / current_setting('block_size')::bigint",
+			[][]byte{[]byte(tableName)}, nil, nil, nil,
+		).Read()
+		if result.Err != nil {
+			return nil, fmt.Errorf("error getting size of %s: %w", tableName, result.Err)
+		}
+		pages, err := strconv.ParseInt(string(result.Rows[0][0]), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		// pages is at most 2^32 so this cannot overflow.
+		for start := step.ChunkSize; start < pages; start += step.ChunkSize {
+			bounds = append(bounds, start)
+		}
+	}
+
+	chunks := make([]*Step, 0, len(bounds)+1)
+	for i := range len(bounds) + 1 {
+		var conditions []string
+		if i > 0 {
+			conditions = append(conditions, chunkBound(step.ChunkBy, column, ">=", bounds[i-1]))
+		}
+		if i < len(bounds) {
+			conditions = append(conditions, chunkBound(step.ChunkBy, column, "<", bounds[i]))
+		}
+		condition := "true"
+		if len(conditions) > 0 {
+			condition = strings.Join(conditions, " and ")
+		}
+
+		chunk := *step
+		chunk.ChunkBy = ""
+		if step.SelectSQL != "" {
+			chunk.SelectSQL = fmt.Sprintf("select * from (%s) pg_partialcopy_chunk where %s", step.SelectSQL, condition)
+		} else {
+			chunk.SelectSQL = fmt.Sprintf("select * from %s where %s", step.TableName, condition)
+		}
+		chunks = append(chunks, &chunk)
+	}
+
+	return chunks, nil
+}
+
+func chunkBound(chunkBy, column, op string, value int64) string {
+	if chunkBy == "ctid" {
+		return fmt.Sprintf("ctid %s '(%d,0)'::tid", op, value)
+	}
+	return fmt.Sprintf("%s %s %d", column, op, value)
+}
+
+type chunkedStep struct {
+	chunks    []*Step
+	mux       sync.Mutex
+	started   bool
+	remaining int
+}
+
+func newChunkedStep(chunks []*Step) *chunkedStep {
+	return &chunkedStep{chunks: chunks, remaining: len(chunks)}
+}
+
+func (cs *chunkedStep) start() bool {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	first := !cs.started
+	cs.started = true
+	return first
+}
+
+func (cs *chunkedStep) finish() bool {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	cs.remaining--
+	return cs.remaining == 0
+}
+
+func copyChunk(ctx context.Context, config *Config, sourceConn, destinationConn *pgconn.PgConn, task stepTask, chunk *Step) error {
+	if config.output != nil {
+		return writeStep(ctx, config, sourceConn, task, chunk)
+	}
+
+	plan, err := planStepCopy(ctx, config, sourceConn, chunk)
+	if err != nil {
+		return err
+	}
+
+	return loadRows(ctx, config, sourceConn, destinationConn, chunk, plan)
+}
+
+func copyChunkWithWorker(ctx context.Context, config *Config, w *copyWorker, task stepTask, chunk *Step) error {
+	err := w.sourceConn.Exec(ctx, "savepoint copy_chunk").Close()
+	if err != nil {
+		return err
+	}
+
+	err = copyChunk(ctx, config, w.sourceConn, w.destinationConn, task, chunk)
+	if err != nil {
+		return err
+	}
+
+	return w.sourceConn.Exec(ctx, "release savepoint copy_chunk").Close()
+}
+
+func (w *copyWorker) recover(ctx context.Context, config *Config, snapshotID string) error {
+	sourceOK := !w.sourceConn.IsClosed() && w.sourceConn.Exec(ctx, "rollback to savepoint copy_chunk; release savepoint copy_chunk").Close() == nil
+	destinationOK := w.destinationConn == nil || !w.destinationConn.IsClosed()
+	if sourceOK && destinationOK {
+		return nil
+	}
+	if !w.owned {
+		return errors.New("connection of the first worker was lost")
+	}
+
+	if !sourceOK {
+		w.sourceConn.Close(ctx)
+		conn, err := connectSourceWithSnapshot(ctx, config.Source.DatabaseURL, snapshotID)
+		if err != nil {
+			return err
+		}
+		w.sourceConn = conn
+	}
+	if !destinationOK {
+		w.destinationConn.Close(ctx)
+		conn, err := pgconn.Connect(ctx, config.Destination.DatabaseURL)
+		if err != nil {
+			return fmt.Errorf("error connecting to destination database: %w", err)
+		}
+		w.destinationConn = conn
+	}
+
+	return nil
+}
+
+func copyChunkWithNewConnections(ctx context.Context, config *Config, snapshotID string, task stepTask, chunk *Step) error {
+	sourceConn, err := connectSourceWithSnapshot(ctx, config.Source.DatabaseURL, snapshotID)
+	if err != nil {
+		return err
+	}
+	defer sourceConn.Close(ctx)
+
+	var destinationConn *pgconn.PgConn
+	if config.output == nil {
+		destinationConn, err = pgconn.Connect(ctx, config.Destination.DatabaseURL)
+		if err != nil {
+			return fmt.Errorf("error connecting to destination database: %w", err)
+		}
+		defer destinationConn.Close(ctx)
+	}
+
+	return copyChunk(ctx, config, sourceConn, destinationConn, task, chunk)
+}
+
+func copyChunkWithRetry(ctx context.Context, config *Config, snapshotID string, w *copyWorker, task stepTask, chunk *Step) error {
+	for attempt := 1; ; attempt++ {
+		var err error
+		if attempt == 1 {
+			err = copyChunkWithWorker(ctx, config, w, task, chunk)
+		} else {
+			err = copyChunkWithNewConnections(ctx, config, snapshotID, task, chunk)
+		}
+		if err == nil {
+			return nil
+		}
+		// The rows of a chunk that failed verification have already been committed.
+		var verr *verificationError
+		if attempt > chunk.ChunkRetries || ctx.Err() != nil || errors.As(err, &verr) {
+			return err
+		}
+
+		if attempt == 1 {
+			recoverErr := w.recover(ctx, config, snapshotID)
+			if recoverErr != nil {
+				return errors.Join(err, recoverErr)
+			}
+		}
+
+		slog.Warn("Retrying chunk", "table_name", chunk.TableName, "attempt", attempt, "error", err)
+		select {
+		case <-time.After(time.Duration(attempt) * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+type goColumnTransform func(value []byte) []byte
+
+func transformCopyText(w io.Writer, r io.Reader, transforms []goColumnTransform) error {
+	br := bufio.NewReaderSize(r, 64*1024)
+	bw := bufio.NewWriterSize(w, 64*1024)
+	var buf []byte
+	var fields [][]byte
+
+	for rowNum := 1; ; rowNum++ {
+		line, err := br.ReadBytes('\n')
+		if len(line) == 0 && err == io.EOF {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		line = bytes.TrimSuffix(line, []byte{'\n'})
+
+		fields = splitCopyTextRow(fields[:0], line)
+		if len(fields) != len(transforms) {
+			return fmt.Errorf("row %d: expected %d columns, got %d", rowNum, len(transforms), len(fields))
+		}
+
+		buf = buf[:0]
+		for i, field := range fields {
+			if i > 0 {
+				buf = append(buf, '\t')
+			}
+			if transforms[i] == nil {
+				buf = append(buf, field...)
+				continue
+			}
+			buf = appendCopyTextValue(buf, transforms[i](decodeCopyTextValue(field)))
+		}
+		buf = append(buf, '\n')
+
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+func splitCopyTextRow(fields [][]byte, line []byte) [][]byte {
+	for {
+		idx := bytes.IndexByte(line, '\t')
+		if idx == -1 {
+			return append(fields, line)
+		}
+		fields = append(fields, line[:idx])
+		line = line[idx+1:]
+	}
+}
+
+func decodeCopyTextValue(field []byte) []byte {
+	if string(field) == `\N` {
+		return nil
+	}
+	if bytes.IndexByte(field, '\\') == -1 {
+		return field
+	}
+
+	value := make([]byte, 0, len(field))
+	for i := 0; i < len(field); i++ {
+		c := field[i]
+		if c != '\\' || i+1 == len(field) {
+			value = append(value, c)
+			continue
+		}
+
+		i++
+		c = field[i]
+		switch c {
+		case 'b':
+			value = append(value, '\b')
+		case 'f':
+			value = append(value, '\f')
+		case 'n':
+			value = append(value, '\n')
+		case 'r':
+			value = append(value, '\r')
+		case 't':
+			value = append(value, '\t')
+		case 'v':
+			value = append(value, '\v')
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			n := c - '0'
+			for j := 0; j < 2 && i+1 < len(field) && field[i+1] >= '0' && field[i+1] <= '7'; j++ {
+				i++
+				n = n*8 + field[i] - '0'
+			}
+			value = append(value, n)
+		case 'x':
+			if i+1 < len(field) && isHexDigit(field[i+1]) {
+				i++
+				n := hexDigitValue(field[i])
+				if i+1 < len(field) && isHexDigit(field[i+1]) {
+					i++
+					n = n*16 + hexDigitValue(field[i])
+				}
+				value = append(value, n)
+			} else {
+				value = append(value, c)
+			}
+		default:
+			value = append(value, c)
+		}
+	}
+
+	return value
+}
+
+func appendCopyTextValue(buf []byte, value []byte) []byte {
+	if value == nil {
+		return append(buf, `\N`...)
+	}
+
+	for _, c := range value {
+		switch c {
+		case '\\':
+			buf = append(buf, `\\`...)
+		case '\b':
+			buf = append(buf, `\b`...)
+		case '\f':
+			buf = append(buf, `\f`...)
+		case '\n':
+			buf = append(buf, `\n`...)
+		case '\r':
+			buf = append(buf, `\r`...)
+		case '\t':
+			buf = append(buf, `\t`...)
+		case '\v':
+			buf = append(buf, `\v`...)
+		default:
+			buf = append(buf, c)
+		}
+	}
+
+	return buf
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexDigitValue(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyTextValueRoundTrip(t *testing.T) {
+	for _, value := range []string{"", "abc", "tab\there", "line\nbreak", `back\slash`, "\r\b\f\v", "日本語"} {
+		encoded := appendCopyTextValue(nil, []byte(value))
+		require.NotContains(t, string(encoded), "\t")
+		require.NotContains(t, string(encoded), "\n")
+		require.Equal(t, value, string(decodeCopyTextValue(encoded)), value)
+	}
+
+	require.Equal(t, `\N`, string(appendCopyTextValue(nil, nil)))
+	require.Nil(t, decodeCopyTextValue([]byte(`\N`)))
+}
+
+func TestDecodeCopyTextValueEscapes(t *testing.T) {
+	require.Equal(t, "A", string(decodeCopyTextValue([]byte(`\101`))))
+	require.Equal(t, "A", string(decodeCopyTextValue([]byte(`\x41`))))
+	require.Equal(t, "\x01z", string(decodeCopyTextValue([]byte(`\x1z`))))
+	require.Equal(t, "q", string(decodeCopyTextValue([]byte(`\q`))))
+}
+
+func TestTransformCopyText(t *testing.T) {
+	upper := func(value []byte) []byte {
+		if value == nil {
+			return nil
+		}
+		return bytes.ToUpper(value)
+	}
+	null := func(value []byte) []byte { return nil }
+
+	input := "1\tmoe\\tx\tkeep\\\\this\n2\t\\N\tlarry\n"
+	output := &bytes.Buffer{}
+	err := transformCopyText(output, strings.NewReader(input), []goColumnTransform{null, upper, nil})
+	require.NoError(t, err)
+	require.Equal(t, "\\N\tMOE\\tX\tkeep\\\\this\n\\N\t\\N\tlarry\n", output.String())
+
+	err = transformCopyText(&bytes.Buffer{}, strings.NewReader("1\t2\n"), []goColumnTransform{nil, nil, nil})
+	require.ErrorContains(t, err, "expected 3 columns, got 2")
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func checkDrift(ctx context.Context, config *Config) ([]string, error) {
+	sourceConn, err := connectSourceForInspection(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	defer sourceConn.Close(ctx)
+
+	steps, err := expandSubsetSteps(ctx, sourceConn, config.Steps)
+	if err != nil {
+		return nil, fmt.Errorf("error expanding subset steps: %w", err)
+	}
+
+	return detectDrift(ctx, config, sourceConn, steps)
+}
+
+type drift struct {
+	Steps              []*stepDrift
+	UncopiedTableNames []string
+}
+
+type stepDrift struct {
+	Index                  int
+	TableName              string
+	TableMissing           bool
+	UnmentionedColumnNames []string
+}
+
+func detectDrift(ctx context.Context, config *Config, sourceConn *pgconn.PgConn, steps []*Step) ([]string, error) {
+	d, err := findDrift(ctx, config, sourceConn, steps)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	for _, sd := range d.Steps {
+		if sd.TableMissing {
+			problems = append(problems, fmt.Sprintf("step %d (%s): table does not exist in source", sd.Index, sd.TableName))
+		}
+		for _, columnName := range sd.UnmentionedColumnNames {
+			problems = append(problems, fmt.Sprintf("step %d (%s): column %s is not mentioned in select_sql", sd.Index, sd.TableName, columnName))
+		}
+	}
+	for _, tableName := range d.UncopiedTableNames {
+		problems = append(problems, fmt.Sprintf("table %s is not copied by any step", tableName))
+	}
+
+	return problems, nil
+}
+
+func findDrift(ctx context.Context, config *Config, sourceConn *pgconn.PgConn, steps []*Step) (*drift, error) {
+	d := &drift{}
+
+	result := sourceConn.ExecParams(ctx, `select c.oid::regclass::text, c.relname
+from pg_class c
+  join pg_namespace n on n.oid = c.relnamespace
+where c.relkind in ('r', 'p')
+  and not c.relispartition
+  and c.relpersistence <> 't'
+  and n.nspname not in ('information_schema', 'pg_catalog')
+  and n.nspname not like 'pg\_toast%'
+order by n.nspname, c.relname`, nil, nil, nil, nil).Read()
+	if result.Err != nil {
+		return nil, fmt.Errorf("error getting source tables: %w", result.Err)
+	}
+
+	stepTableNames := make(map[string]bool, len(steps))
+	for i, step := range steps {
+		tableName, err := resolveTableName(ctx, sourceConn, step.TableName)
+		if err != nil {
+			return nil, err
+		}
+		if tableName == "" {
+			if step.BeforeCopySQL == "" {
+				d.Steps = append(d.Steps, &stepDrift{Index: i, TableName: step.TableName, TableMissing: true})
+			}
+			continue
+		}
+		stepTableNames[tableName] = true
+
+		if (step.SelectSQL == "" && len(step.ColumnNames) == 0) || step.Where != "" || step.generated {
+			continue
+		}
+		columnNamesSQL := strings.Join(step.ColumnNames, ", ")
+
+		rules, err := columnRulesForStep(ctx, sourceConn, &config.Masking, step)
+		if err != nil {
+			return nil, err
+		}
+
+		columns, err := getTableColumns(ctx, sourceConn, tableName)
+		if err != nil {
+			return nil, err
+		}
+		var unmentionedColumnNames []string
+		for _, column := range columns {
+			if column.Generated || rules[column.Name] != nil {
+				continue
+			}
+			if !sqlMentions(step.SelectSQL, column.Name) && !sqlMentions(columnNamesSQL, column.Name) {
+				unmentionedColumnNames = append(unmentionedColumnNames, column.Name)
+			}
+		}
+		if len(unmentionedColumnNames) > 0 {
+			d.Steps = append(d.Steps, &stepDrift{Index: i, TableName: step.TableName, UnmentionedColumnNames: unmentionedColumnNames})
+		}
+	}
+
+	var comments []string
+	for _, step := range steps {
+		comments = append(comments, sqlComments(step.SelectSQL)...)
+	}
+	commentsSQL := strings.Join(comments, "\n")
+
+	for _, row := range result.Rows {
+		tableName := string(row[0])
+		relName := string(row[1])
+		if stepTableNames[tableName] {
+			continue
+		}
+
+		if !sqlMentions(commentsSQL, relName) {
+			d.UncopiedTableNames = append(d.UncopiedTableNames, tableName)
+		}
+	}
+
+	return d, nil
+}
+
+func sqlMentions(sql, name string) bool {
+	if sql == "" || name == "" {
+		return false
+	}
+
+	sql = strings.ToLower(sql)
+	name = strings.ToLower(name)
+	for offset := 0; ; {
+		i := strings.Index(sql[offset:], name)
+		if i < 0 {
+			return false
+		}
+		start := offset + i
+		end := start + len(name)
+
+		before, _ := utf8.DecodeLastRuneInString(sql[:start])
+		after, _ := utf8.DecodeRuneInString(sql[end:])
+		if !isSQLWordRune(before) && !isSQLWordRune(after) {
+			return true
+		}
+		offset = start + 1
+	}
+}
+
+func isSQLWordRune(r rune) bool {
+	return r == '_' || r == '$' || unicode.IsLetter(r) || unicode.IsNumber(r)
+}
+
+func sqlComments(sql string) []string {
+	var comments []string
+	for i := 0; i < len(sql); {
+		switch {
+		case sql[i] == '\'' || sql[i] == '"':
+			end := strings.IndexByte(sql[i+1:], sql[i])
+			if end < 0 {
+				return comments
+			}
+			// A doubled quote is an escaped quote.
+			i += end + 2
+		case strings.HasPrefix(sql[i:], "--"):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				end = len(sql) - i
+			}
+			comments = append(comments, sql[i+2:i+end])
+			i += end
+		case strings.HasPrefix(sql[i:], "/*"):
+			// Block comments can be nested.
+			depth := 0
+			j := i
+			for j < len(sql) {
+				if strings.HasPrefix(sql[j:], "/*") {
+					depth++
+					j += 2
+				} else if strings.HasPrefix(sql[j:], "*/") {
+					depth--
+					j += 2
+					if depth == 0 {
+						break
+					}
+				} else {
+					j++
+				}
+			}
+			comments = append(comments, sql[i:j])
+			i = j
+		default:
+			i++
+		}
+	}
+	return comments
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLMentions(t *testing.T) {
+	require.True(t, sqlMentions("select id, name from users", "name"))
+	require.True(t, sqlMentions("select ID from users", "id"))
+	require.True(t, sqlMentions("select id from users", "users"))
+	require.True(t, sqlMentions("select u.name_of from users u where name = 'x'", "name"))
+	require.False(t, sqlMentions("select user_name, name2, $name from users", "name"))
+	require.False(t, sqlMentions("select név from users", "né"))
+	require.False(t, sqlMentions("", "name"))
+}
+
+func TestSQLComments(t *testing.T) {
+	require.Equal(t, []string{
+		" b is not copied",
+		"/* c /* nested */ d */",
+	}, sqlComments(`select '--', "a--b" -- b is not copied
+from a /* c /* nested */ d */ where x = 'it''s -- not a comment'`))
+	require.Nil(t, sqlComments("select id from a"))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+func parsePatternList(s string) []string {
+	var patterns []string
+	for pattern := range strings.SplitSeq(s, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+func (config *Config) filterSteps() error {
+	if len(config.OnlyPatterns) == 0 && len(config.SkipPatterns) == 0 {
+		return nil
+	}
+
+	steps, err := filterSteps(config.Steps, config.OnlyPatterns, config.SkipPatterns)
+	if err != nil {
+		return err
+	}
+	config.Steps = steps
+
+	return nil
+}
+
+func filterSteps(steps []*Step, only, skip []string) ([]*Step, error) {
+	onlyMatched := make([]bool, len(only))
+	var filteredSteps []*Step
+	for _, step := range steps {
+		keep := len(only) == 0
+		for i, pattern := range only {
+			matched, err := path.Match(pattern, step.TableName)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+			}
+			if matched {
+				onlyMatched[i] = true
+				keep = true
+			}
+		}
+		for _, pattern := range skip {
+			matched, err := path.Match(pattern, step.TableName)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+			}
+			if matched {
+				keep = false
+			}
+		}
+		if keep {
+			filteredSteps = append(filteredSteps, step)
+		}
+	}
+
+	for i, pattern := range only {
+		if !onlyMatched[i] {
+			return nil, fmt.Errorf("only pattern %s does not match any step", pattern)
+		}
+	}
+	if len(filteredSteps) == 0 {
+		return nil, fmt.Errorf("no steps remain after filtering")
+	}
+
+	return filteredSteps, nil
+}
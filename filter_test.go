@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterSteps(t *testing.T) {
+	steps := []*Step{{TableName: "users"}, {TableName: "orders"}, {TableName: "audit_log"}, {TableName: "audit_events"}}
+	tableNames := func(steps []*Step) []string {
+		var names []string
+		for _, step := range steps {
+			names = append(names, step.TableName)
+		}
+		return names
+	}
+
+	filtered, err := filterSteps(steps, parsePatternList("users, orders"), nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"users", "orders"}, tableNames(filtered))
+
+	filtered, err = filterSteps(steps, nil, parsePatternList("audit_*"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"users", "orders"}, tableNames(filtered))
+
+	filtered, err = filterSteps(steps, parsePatternList("audit_*"), parsePatternList("audit_log"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"audit_events"}, tableNames(filtered))
+
+	_, err = filterSteps(steps, parsePatternList("user"), nil)
+	require.EqualError(t, err, "only pattern user does not match any step")
+
+	_, err = filterSteps(steps, nil, parsePatternList("*"))
+	require.EqualError(t, err, "no steps remain after filtering")
+
+	_, err = filterSteps(steps, parsePatternList("[users"), nil)
+	require.ErrorContains(t, err, "invalid pattern [users")
+}
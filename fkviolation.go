@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const foreignKeyViolationSampleSize = 5
+
+func (config *Config) validateOnFKViolation() error {
+	switch config.OnFKViolation {
+	case "":
+		return nil
+	case "error", "delete", "not_valid", "prune":
+	default:
+		return fmt.Errorf("unknown on_fk_violation: %s", config.OnFKViolation)
+	}
+
+	if config.Destination.Type != "" && config.Destination.Type != "database" {
+		return fmt.Errorf("on_fk_violation cannot be used with destination.type %s", config.Destination.Type)
+	}
+
+	return nil
+}
+
+func (config *Config) createForeignKeysNotValid() bool {
+	return config.OnFKViolation == "not_valid" || (config.OnFKViolation == "" && config.refresh())
+}
+
+type foreignKeyViolation struct {
+	ForeignKey *foreignKey
+	Count      int64
+	Samples    []string
+}
+
+func (fk *foreignKey) violationCondition(alias string) string {
+	var conditions, matches []string
+	for i, column := range fk.ColumnNames {
+		conditions = append(conditions, fmt.Sprintf("%s.%s is not null", alias, column))
+		matches = append(matches, fmt.Sprintf("pg_partialcopy_referenced.%s = %s.%s", fk.ReferencedColumnNames[i], alias, column))
+	}
+	conditions = append(conditions, fmt.Sprintf("not exists (select 1 from %s pg_partialcopy_referenced where %s)",
+		fk.ReferencedTableName, strings.Join(matches, " and "),
+	))
+	return strings.Join(conditions, " and ")
+}
+
+func findForeignKeyViolation(ctx context.Context, conn *pgconn.PgConn, fk *foreignKey) (*foreignKeyViolation, error) {
+	condition := fk.violationCondition("t")
+
+	result := conn.ExecParams(ctx,
+		fmt.Sprintf("select count(*) from %s t where %s", fk.TableName, condition),
+		nil, nil, nil, nil,
+	).Read()
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	count, err := strconv.ParseInt(string(result.Rows[0][0]), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, nil
+	}
+
+	columns := make([]string, len(fk.ColumnNames))
+	for i, column := range fk.ColumnNames {
+		columns[i] = "t." + column
+	}
+	result = conn.ExecParams(ctx,
+		fmt.Sprintf("select row(%s)::text from %s t where %s limit %d", strings.Join(columns, ", "), fk.TableName, condition, foreignKeyViolationSampleSize),
+		nil, nil, nil, nil,
+	).Read()
+	if result.Err != nil {
+		return nil, result.Err
+	}
+
+	violation := &foreignKeyViolation{ForeignKey: fk, Count: count}
+	for _, row := range result.Rows {
+		violation.Samples = append(violation.Samples, string(row[0]))
+	}
+
+	return violation, nil
+}
+
+func (v *foreignKeyViolation) describe(stepIdxs map[string]int) string {
+	fk := v.ForeignKey
+	s := fmt.Sprintf("%s: %d rows of %s violate foreign key (%s) references %s (%s). e.g. %s.",
+		fk.Name,
+		v.Count,
+		fk.TableName,
+		strings.Join(fk.ColumnNames, ", "),
+		fk.ReferencedTableName,
+		strings.Join(fk.ReferencedColumnNames, ", "),
+		strings.Join(v.Samples, ", "),
+	)
+
+	describeStep := func(tableName string) string {
+		if i, ok := stepIdxs[tableName]; ok {
+			return fmt.Sprintf("step %d (%s)", i, tableName)
+		}
+		return fmt.Sprintf("%s (not copied by any step)", tableName)
+	}
+	return s + fmt.Sprintf(" Check the select_sql of %s and %s.", describeStep(fk.TableName), describeStep(fk.ReferencedTableName))
+}
+
+func handleForeignKeyViolations(ctx context.Context, conn *pgconn.PgConn, config *Config, foreignKeys []*foreignKey) error {
+	if config.OnFKViolation == "prune" {
+		return pruneForeignKeyViolations(ctx, conn, foreignKeys)
+	}
+
+	stepIdxs := make(map[string]int, len(config.Steps))
+	for i, step := range config.Steps {
+		tableName, err := resolveTableName(ctx, conn, step.TableName)
+		if err != nil {
+			return err
+		}
+		if _, present := stepIdxs[tableName]; tableName != "" && !present {
+			stepIdxs[tableName] = i
+		}
+	}
+
+	var problems []string
+	for _, fk := range foreignKeys {
+		violation, err := findForeignKeyViolation(ctx, conn, fk)
+		if err != nil {
+			return fmt.Errorf("error checking foreign key constraint %s: %w", fk.Name, err)
+		}
+		if violation == nil {
+			continue
+		}
+		problem := violation.describe(stepIdxs)
+		problems = append(problems, problem)
+
+		switch config.OnFKViolation {
+		case "error":
+			slog.Error("Foreign key constraint violated", "constraint", fk.Name, "table_name", fk.TableName, "rows", violation.Count)
+		case "delete":
+			err := conn.Exec(ctx, fmt.Sprintf("delete from %s t where %s", fk.TableName, fk.violationCondition("t"))).Close()
+			if err != nil {
+				return fmt.Errorf("error deleting rows that violate foreign key constraint %s: %w", fk.Name, err)
+			}
+			slog.Warn("Deleted rows that violate foreign key constraint", "constraint", fk.Name, "table_name", fk.TableName, "rows", violation.Count, "report", problem)
+		case "not_valid":
+			slog.Warn("Foreign key constraint will be created as not valid", "constraint", fk.Name, "table_name", fk.TableName, "rows", violation.Count, "report", problem)
+		}
+	}
+
+	if config.OnFKViolation == "error" && len(problems) > 0 {
+		return fmt.Errorf("foreign key constraints are violated by the copied rows:\n%s", strings.Join(problems, "\n"))
+	}
+	slog.Info("Checked foreign key constraints", "count", len(foreignKeys), "violated", len(problems))
+
+	return nil
+}
+
+func pruneForeignKeyViolations(ctx context.Context, conn *pgconn.PgConn, foreignKeys []*foreignKey) error {
+	var total int64
+	for pass := 1; ; pass++ {
+		var pruned int64
+		for _, fk := range foreignKeys {
+			n, err := pruneForeignKeyViolation(ctx, conn, fk)
+			if err != nil {
+				return fmt.Errorf("error pruning rows that violate foreign key constraint %s: %w", fk.Name, err)
+			}
+			if n > 0 {
+				slog.Warn("Pruned rows that violate foreign key constraint", "constraint", fk.Name, "table_name", fk.TableName, "on_delete", fk.OnDelete, "rows", n, "pass", pass)
+			}
+			pruned += n
+		}
+
+		total += pruned
+		if pruned == 0 {
+			slog.Info("Pruned rows that violate foreign key constraints", "count", len(foreignKeys), "rows", total, "passes", pass)
+			return nil
+		}
+	}
+}
+
+func pruneForeignKeyViolation(ctx context.Context, conn *pgconn.PgConn, fk *foreignKey) (int64, error) {
+	condition := fk.violationCondition("t")
+
+	var pruned int64
+	var value string
+	switch fk.OnDelete {
+	case "set null":
+		value = "null"
+	case "set default":
+		value = "default"
+	case "cascade":
+	default:
+		violation, err := findForeignKeyViolation(ctx, conn, fk)
+		if err != nil {
+			return 0, err
+		}
+		if violation != nil {
+			return 0, fmt.Errorf("%d rows of %s violate foreign key constraint %s, which is on delete %s. e.g. %s",
+				violation.Count, fk.TableName, fk.Name, fk.OnDelete, strings.Join(violation.Samples, ", "),
+			)
+		}
+		return 0, nil
+	}
+	if value != "" {
+		assignments := make([]string, len(fk.ColumnNames))
+		for i, column := range fk.ColumnNames {
+			assignments[i] = fmt.Sprintf("%s = %s", column, value)
+		}
+		result := conn.ExecParams(ctx,
+			fmt.Sprintf("update %s t set %s where %s", fk.TableName, strings.Join(assignments, ", "), condition),
+			nil, nil, nil, nil,
+		).Read()
+		if result.Err != nil {
+			return 0, result.Err
+		}
+		pruned += result.CommandTag.RowsAffected()
+	}
+
+	result := conn.ExecParams(ctx, fmt.Sprintf("delete from %s t where %s", fk.TableName, condition), nil, nil, nil, nil).Read()
+	if result.Err != nil {
+		return 0, result.Err
+	}
+	pruned += result.CommandTag.RowsAffected()
+
+	return pruned, nil
+}
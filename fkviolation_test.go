@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestForeignKeyViolationCondition(t *testing.T) {
+	fk := &foreignKey{
+		Name:                  "line_items_order_fkey",
+		TableName:             "line_items",
+		ColumnNames:           []string{"order_id", `"Shop"`},
+		ReferencedTableName:   "orders",
+		ReferencedColumnNames: []string{"id", "shop_id"},
+	}
+	require.Equal(t,
+		`t.order_id is not null and t."Shop" is not null and not exists (select 1 from orders pg_partialcopy_referenced where pg_partialcopy_referenced.id = t.order_id and pg_partialcopy_referenced.shop_id = t."Shop")`,
+		fk.violationCondition("t"),
+	)
+
+	v := &foreignKeyViolation{ForeignKey: fk, Count: 12, Samples: []string{"(4,1)", "(7,1)"}}
+	require.Equal(t,
+		`line_items_order_fkey: 12 rows of line_items violate foreign key (order_id, "Shop") references orders (id, shop_id). e.g. (4,1), (7,1). Check the select_sql of step 3 (line_items) and orders (not copied by any step).`,
+		v.describe(map[string]int{"line_items": 3}),
+	)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"golang.org/x/sync/errgroup"
+)
+
+type flatFileOutput struct {
+	*stepFiles
+
+	dir    string
+	format string
+}
+
+func newFlatFileOutput(dir, format string) (*flatFileOutput, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating output directory: %w", err)
+	}
+
+	sf, err := newStepFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &flatFileOutput{stepFiles: sf, dir: dir, format: format}, nil
+}
+
+func (o *flatFileOutput) writeStep(ctx context.Context, sourceConn *pgconn.PgConn, task stepTask, step *Step, plan *stepCopyPlan) error {
+	sd, err := sourceConn.Prepare(ctx, "", plan.SelectSQL, nil)
+	if err != nil {
+		return fmt.Errorf("error describing select SQL: %w", err)
+	}
+	columns := sd.Fields
+
+	return o.write(task, step, plan, func(w io.Writer) error {
+		bw := bufio.NewWriterSize(w, 64*1024)
+
+		var appendRow func(buf []byte, fields [][]byte) []byte
+		switch o.format {
+		case "csv":
+			// The header is written with the first chunk so the files of the chunks can be concatenated.
+			if task.chunkIdx <= 0 {
+				names := make([][]byte, len(columns))
+				for i, c := range columns {
+					names[i] = []byte(c.Name)
+				}
+				bw.Write(appendCSVRow(nil, names))
+			}
+			appendRow = appendCSVRow
+		case "jsonl":
+			appendRow = func(buf []byte, fields [][]byte) []byte {
+				return appendJSONRow(buf, columns, fields)
+			}
+		}
+
+		r, pw := io.Pipe()
+		g := &errgroup.Group{}
+		g.Go(func() error {
+			defer pw.Close()
+
+			_, err := writeRows(ctx, sourceConn, pw, plan)
+			if err != nil {
+				pw.CloseWithError(err)
+				return err
+			}
+
+			return nil
+		})
+
+		g.Go(func() error {
+			err := convertCopyText(bw, r, len(columns), appendRow)
+			if err != nil {
+				r.CloseWithError(err)
+				return err
+			}
+
+			return bw.Flush()
+		})
+
+		return g.Wait()
+	})
+}
+
+func (o *flatFileOutput) finish(structure *sourceStructure) error {
+	for _, as := range o.sortedSteps() {
+		path := filepath.Join(o.dir, flatFileName(as.TableName)+"."+o.format)
+		err := writeFile(path, func(w io.Writer) error {
+			for _, name := range as.Files {
+				err := copyFileTo(w, o.filePath(name))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("error writing %s: %w", path, err)
+		}
+	}
+	slog.Info("Wrote files", "dir", o.dir, "format", o.format)
+
+	return nil
+}
+
+func flatFileName(tableName string) string {
+	return strings.NewReplacer(`"`, "", "/", "_", `\`, "_").Replace(tableName)
+}
+
+func convertCopyText(w io.Writer, r io.Reader, columnCount int, appendRow func(buf []byte, values [][]byte) []byte) error {
+	var buf []byte
+	return readCopyText(r, columnCount, func(values [][]byte) error {
+		buf = appendRow(buf[:0], values)
+		_, err := w.Write(buf)
+		return err
+	})
+}
+
+func readCopyText(r io.Reader, columnCount int, fn func(values [][]byte) error) error {
+	br := bufio.NewReaderSize(r, 64*1024)
+	var fields [][]byte
+
+	for rowNum := 1; ; rowNum++ {
+		line, err := br.ReadBytes('\n')
+		if len(line) == 0 && err == io.EOF {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		line = bytes.TrimSuffix(line, []byte{'\n'})
+
+		fields = splitCopyTextRow(fields[:0], line)
+		if len(fields) != columnCount {
+			return fmt.Errorf("row %d: expected %d columns, got %d", rowNum, columnCount, len(fields))
+		}
+		for i, field := range fields {
+			fields[i] = decodeCopyTextValue(field)
+		}
+
+		err = fn(fields)
+		if err != nil {
+			return fmt.Errorf("row %d: %w", rowNum, err)
+		}
+	}
+
+	return nil
+}
+
+func appendCSVRow(buf []byte, values [][]byte) []byte {
+	for i, value := range values {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		if value == nil {
+			continue
+		}
+		if len(value) > 0 && !bytes.ContainsAny(value, ",\"\r\n") {
+			buf = append(buf, value...)
+			continue
+		}
+		buf = append(buf, '"')
+		buf = append(buf, bytes.ReplaceAll(value, []byte(`"`), []byte(`""`))...)
+		buf = append(buf, '"')
+	}
+	return append(buf, '\n')
+}
+
+func appendJSONRow(buf []byte, columns []pgconn.FieldDescription, values [][]byte) []byte {
+	buf = append(buf, '{')
+	for i, value := range values {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = appendJSONString(buf, columns[i].Name)
+		buf = append(buf, ':')
+		buf = appendJSONValue(buf, columns[i].DataTypeOID, value)
+	}
+	return append(buf, '}', '\n')
+}
+
+func appendJSONValue(buf []byte, oid uint32, value []byte) []byte {
+	if value == nil {
+		return append(buf, "null"...)
+	}
+
+	switch oid {
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID, pgtype.OIDOID, pgtype.Float4OID, pgtype.Float8OID, pgtype.NumericOID:
+		// NaN and Infinity are not valid JSON numbers.
+		if json.Valid(value) {
+			return append(buf, value...)
+		}
+	case pgtype.BoolOID:
+		if string(value) == "t" {
+			return append(buf, "true"...)
+		}
+		return append(buf, "false"...)
+	case pgtype.JSONOID, pgtype.JSONBOID:
+		// json values can contain newlines and a masked value may not be JSON at all.
+		b := bytes.NewBuffer(buf)
+		if json.Compact(b, value) == nil {
+			return b.Bytes()
+		}
+	}
+
+	return appendJSONString(buf, string(value))
+}
+
+func appendJSONString(buf []byte, s string) []byte {
+	b, _ := json.Marshal(s)
+	return append(buf, b...)
+}
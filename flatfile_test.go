@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertCopyTextToCSV(t *testing.T) {
+	copyText := "1\tplain\t\\N\n2\t\tcomma, \"quote\"\n3\tline\\nbreak\ttab\\there\n"
+
+	buf := &bytes.Buffer{}
+	err := convertCopyText(buf, strings.NewReader(copyText), 3, appendCSVRow)
+	require.NoError(t, err)
+	require.Equal(t, "1,plain,\n2,\"\",\"comma, \"\"quote\"\"\"\n3,\"line\nbreak\",tab\there\n", buf.String())
+
+	err = convertCopyText(buf, strings.NewReader("1\t2\n"), 3, appendCSVRow)
+	require.EqualError(t, err, "row 1: expected 3 columns, got 2")
+}
+
+func TestConvertCopyTextToJSONL(t *testing.T) {
+	columns := []pgconn.FieldDescription{
+		{Name: "id", DataTypeOID: pgtype.Int8OID},
+		{Name: "amount", DataTypeOID: pgtype.NumericOID},
+		{Name: "active", DataTypeOID: pgtype.BoolOID},
+		{Name: "data", DataTypeOID: pgtype.JSONBOID},
+		{Name: "name", DataTypeOID: pgtype.TextOID},
+	}
+	copyText := "1\t12.50\tt\t{\"a\": [1, 2]}\tSay \"hi\"\\n\n2\tNaN\tf\t\\N\t\\N\n"
+
+	buf := &bytes.Buffer{}
+	err := convertCopyText(buf, strings.NewReader(copyText), len(columns), func(buf []byte, values [][]byte) []byte {
+		return appendJSONRow(buf, columns, values)
+	})
+	require.NoError(t, err)
+	require.Equal(t,
+		`{"id":1,"amount":12.50,"active":true,"data":{"a":[1,2]},"name":"Say \"hi\"\n"}`+"\n"+
+			`{"id":2,"amount":"NaN","active":false,"data":null,"name":null}`+"\n",
+		buf.String(),
+	)
+}
+
+func TestConvertCopyTextToJSONLMultilineJSON(t *testing.T) {
+	columns := []pgconn.FieldDescription{
+		{Name: "id", DataTypeOID: pgtype.Int8OID},
+		{Name: "data", DataTypeOID: pgtype.JSONOID},
+	}
+	copyText := "1\t{\\n  \"a\": [\\n    1,\\n    \"x\\\\ny\"\\n  ]\\n}\n"
+
+	buf := &bytes.Buffer{}
+	err := convertCopyText(buf, strings.NewReader(copyText), len(columns), func(buf []byte, values [][]byte) []byte {
+		return appendJSONRow(buf, columns, values)
+	})
+	require.NoError(t, err)
+	require.Equal(t, `{"id":1,"data":{"a":[1,"x\ny"]}}`+"\n", buf.String())
+}
+
+func TestConvertCopyTextToJSONLInvalidJSON(t *testing.T) {
+	columns := []pgconn.FieldDescription{
+		{Name: "data", DataTypeOID: pgtype.JSONBOID},
+	}
+	copyText := "{\"i\n"
+
+	buf := &bytes.Buffer{}
+	err := convertCopyText(buf, strings.NewReader(copyText), len(columns), func(buf []byte, values [][]byte) []byte {
+		return appendJSONRow(buf, columns, values)
+	})
+	require.NoError(t, err)
+	require.Equal(t, `{"data":"{\"i"}`+"\n", buf.String())
+}
+
+func TestFlatFileName(t *testing.T) {
+	require.Equal(t, "users", flatFileName("users"))
+	require.Equal(t, "special characters.Foo bar", flatFileName(`"special characters"."Foo bar"`))
+}
@@ -12,6 +12,18 @@ var initFlag = flag.Bool("init", false, "Initialize config file")
 var sourceURL = flag.String("source", "", "Source database URL or key-value connection string. Required if init is set. Overrides config file if run without init.")
 var destinationURL = flag.String("destination", "", "Destination database URL or key-value connection string. Overrides config file if run without init.")
 var omitSelectSQL = flag.Bool("omitselectsql", false, "Omit select_sql from the config file")
+var updateFlag = flag.Bool("update", false, "Append steps for tables that are not in the config file")
+var commentOut = flag.Bool("commentout", false, "Comment out the steps appended by update")
+var jobs = flag.Int("jobs", 0, "Number of steps to execute concurrently. Overrides config file.")
+var resume = flag.Bool("resume", false, "Resume the run recorded in the checkpoint file")
+var planFlag = flag.Bool("plan", false, "Print what would be done without preparing or copying to the destination")
+var validateFlag = flag.Bool("validate", false, "Check the config file for problems")
+var driftFlag = flag.Bool("drift", false, "Report source tables and columns that the config does not account for")
+var restore = flag.Bool("restore", false, "Restore the archive given instead of a config file to destination")
+var only = flag.String("only", "", "Comma separated table name patterns of the steps to execute. Other steps are skipped.")
+var skip = flag.String("skip", "", "Comma separated table name patterns of the steps to skip")
+var reportFile = flag.String("report", "", "Write a JSON report of the run to this file")
+var skipStructure = flag.Bool("skipstructure", false, "Keep the structure and the other tables of the destination. Same as destination.mode = \"refresh\".")
 
 func main() {
 	flag.Usage = func() {
@@ -60,17 +72,84 @@ func main() {
 		return
 	}
 
-	config, err := parseConfigFile(configFilePath)
+	if *restore {
+		if *destinationURL == "" {
+			flag.Usage()
+			fmt.Printf("\nError: destination is required when restore is set\n")
+			return
+		}
+
+		config := &Config{Parallelism: *jobs, Destination: ConfigDestination{DatabaseURL: *destinationURL}}
+		err := restoreArchive(ctx, configFilePath, config)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	renderedConfig, err := renderConfigFile(configFilePath)
 	if err != nil {
 		slog.Error(err.Error())
 		os.Exit(1)
 	}
 
-	if *sourceURL != "" {
-		config.Source.DatabaseURL = *sourceURL
+	config, err := decodeConfig(renderedConfig)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
 	}
-	if *destinationURL != "" {
-		config.Destination.DatabaseURL = *destinationURL
+
+	applyFlags(config)
+
+	if *updateFlag {
+		err = updateConfigFile(ctx, configFilePath, config, *omitSelectSQL, *commentOut)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *validateFlag {
+		problems, err := validateConfig(ctx, config)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("Config is valid")
+		return
+	}
+
+	if *driftFlag {
+		problems, err := checkDrift(ctx, config)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("No drift")
+		return
+	}
+
+	if *planFlag {
+		err = printPlan(ctx, os.Stdout, config, renderedConfig)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		return
 	}
 
 	err = pgPartialCopy(ctx, config)
@@ -79,3 +158,22 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+func applyFlags(config *Config) {
+	if *sourceURL != "" {
+		config.Source.DatabaseURL = *sourceURL
+	}
+	if *destinationURL != "" {
+		config.Destination.DatabaseURL = *destinationURL
+	}
+	if *jobs > 0 {
+		config.Parallelism = *jobs
+	}
+	config.Resume = *resume
+	config.ReportFile = *reportFile
+	config.OnlyPatterns = parsePatternList(*only)
+	config.SkipPatterns = parsePatternList(*skip)
+	if *skipStructure {
+		config.Destination.Mode = "refresh"
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+type ConfigMasking struct {
+	Engine  string        `toml:"engine"`
+	Key     string        `toml:"key"`
+	Columns []*ColumnRule `toml:"columns"`
+}
+
+type ColumnRule struct {
+	TableName   string `toml:"table_name"`
+	Name        string `toml:"name"`
+	Transformer string `toml:"transformer"`
+	Value       string `toml:"value"`
+	Length      int    `toml:"length"`
+	Pattern     string `toml:"pattern"`
+	Replacement string `toml:"replacement"`
+}
+
+var fakeFirstNames = []string{
+	"James", "Mary", "Robert", "Patricia", "John", "Jennifer", "Michael", "Linda", "David", "Elizabeth",
+	"William", "Barbara", "Richard", "Susan", "Joseph", "Jessica", "Thomas", "Sarah", "Charles", "Karen",
+}
+
+var fakeLastNames = []string{
+	"Smith", "Johnson", "Williams", "Brown", "Jones", "Garcia", "Miller", "Davis", "Rodriguez", "Martinez",
+	"Hernandez", "Lopez", "Gonzalez", "Wilson", "Anderson", "Thomas", "Taylor", "Moore", "Jackson", "Martin",
+}
+
+func (masking *ConfigMasking) engine() (string, error) {
+	switch masking.Engine {
+	case "":
+		if masking.Key != "" {
+			return "go", nil
+		}
+		return "sql", nil
+	case "sql":
+		// The key would be visible in the logs and statistics of the source.
+		if masking.Key != "" {
+			return "", fmt.Errorf("masking.key cannot be used with masking.engine sql")
+		}
+		return "sql", nil
+	case "go":
+		return "go", nil
+	default:
+		return "", fmt.Errorf("unknown masking engine: %s", masking.Engine)
+	}
+}
+
+func (rule *ColumnRule) validate() error {
+	if rule.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+
+	switch rule.Transformer {
+	case "null", "constant", "hash", "fake_email", "fake_name", "shuffle":
+	case "truncate":
+		if rule.Length < 1 {
+			return fmt.Errorf("column %s: truncate requires length greater than 0", rule.Name)
+		}
+	case "regex_replace":
+		if rule.Pattern == "" {
+			return fmt.Errorf("column %s: regex_replace requires pattern", rule.Name)
+		}
+	case "":
+		return fmt.Errorf("column %s: transformer is required", rule.Name)
+	default:
+		return fmt.Errorf("column %s: unknown transformer %s", rule.Name, rule.Transformer)
+	}
+
+	return nil
+}
+
+func (rule *ColumnRule) sqlExpr(expr string) string {
+	text := expr + "::text"
+	digest := fmt.Sprintf("md5(%s)", text)
+	switch rule.Transformer {
+	case "null":
+		return "null"
+	case "constant":
+		return quoteLiteral(rule.Value)
+	case "hash":
+		return digest
+	case "fake_email":
+		return fmt.Sprintf("'user_' || left(%s, 12) || '@example.com'", digest)
+	case "fake_name":
+		return fmt.Sprintf(
+			"case when %s is null then null else (%s)[1 + ('x' || substr(%s, 1, 7))::bit(28)::int %% %d] || ' ' || (%s)[1 + ('x' || substr(%s, 8, 7))::bit(28)::int %% %d] end",
+			expr,
+			sqlTextArray(fakeFirstNames), digest, len(fakeFirstNames),
+			sqlTextArray(fakeLastNames), digest, len(fakeLastNames),
+		)
+	case "truncate":
+		return fmt.Sprintf("left(%s, %d)", text, rule.Length)
+	case "regex_replace":
+		return fmt.Sprintf("regexp_replace(%s, %s, %s, 'g')", text, quoteLiteral(rule.Pattern), quoteLiteral(rule.Replacement))
+	default:
+		panic("unsupported transformer: " + rule.Transformer)
+	}
+}
+
+func (rule *ColumnRule) goTransform(key string) (goColumnTransform, error) {
+	switch rule.Transformer {
+	case "null":
+		return func(value []byte) []byte { return nil }, nil
+	case "constant":
+		return func(value []byte) []byte { return []byte(rule.Value) }, nil
+	case "hash":
+		return func(value []byte) []byte {
+			if value == nil {
+				return nil
+			}
+			return []byte(goDigestHex(value, key))
+		}, nil
+	case "fake_email":
+		return func(value []byte) []byte {
+			if value == nil {
+				return nil
+			}
+			return []byte("user_" + goDigestHex(value, key)[:12] + "@example.com")
+		}, nil
+	case "fake_name":
+		return func(value []byte) []byte {
+			if value == nil {
+				return nil
+			}
+			digest := goDigestHex(value, key)
+			first, _ := strconv.ParseUint(digest[0:7], 16, 32)
+			last, _ := strconv.ParseUint(digest[7:14], 16, 32)
+			return []byte(fakeFirstNames[first%uint64(len(fakeFirstNames))] + " " + fakeLastNames[last%uint64(len(fakeLastNames))])
+		}, nil
+	case "truncate":
+		return func(value []byte) []byte {
+			if value == nil {
+				return nil
+			}
+			n := 0
+			for i := range value {
+				if utf8.RuneStart(value[i]) {
+					if n == rule.Length {
+						return value[:i]
+					}
+					n++
+				}
+			}
+			return value
+		}, nil
+	case "regex_replace":
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", rule.Name, err)
+		}
+		replacement := []byte(rule.Replacement)
+		return func(value []byte) []byte {
+			if value == nil {
+				return nil
+			}
+			return re.ReplaceAll(value, replacement)
+		}, nil
+	case "shuffle":
+		return nil, fmt.Errorf("column %s: shuffle is not supported by the go engine", rule.Name)
+	default:
+		panic("unsupported transformer: " + rule.Transformer)
+	}
+}
+
+func (masking *ConfigMasking) validatePatterns(ctx context.Context, conn *pgconn.PgConn, step *Step) error {
+	engine, err := masking.engine()
+	if err != nil {
+		return nil
+	}
+
+	rules, err := columnRulesForStep(ctx, conn, masking, step)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(rules))
+	for name := range rules {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		rule := rules[name]
+		if rule.Transformer != "regex_replace" {
+			continue
+		}
+		if engine == "go" {
+			_, err = regexp.Compile(rule.Pattern)
+		} else {
+			err = conn.ExecParams(ctx, "select regexp_replace('', $1, '')", [][]byte{[]byte(rule.Pattern)}, nil, nil, nil).Read().Err
+		}
+		if err != nil {
+			return fmt.Errorf("column %s: invalid pattern for masking.engine %s: %w", rule.Name, engine, err)
+		}
+	}
+
+	return nil
+}
+
+func columnRulesForStep(ctx context.Context, conn *pgconn.PgConn, masking *ConfigMasking, step *Step) (map[string]*ColumnRule, error) {
+	rules := make(map[string]*ColumnRule)
+
+	for _, rule := range masking.Columns {
+		if rule.TableName == "" {
+			err := rule.validate()
+			if err != nil {
+				return nil, fmt.Errorf("masking: %w", err)
+			}
+			rules[rule.Name] = rule
+		}
+	}
+
+	var stepTableName string
+	for _, rule := range masking.Columns {
+		if rule.TableName == "" {
+			continue
+		}
+		if rule.TableName != step.TableName {
+			if stepTableName == "" {
+				var err error
+				stepTableName, err = resolveTableName(ctx, conn, step.TableName)
+				if err != nil {
+					return nil, err
+				}
+			}
+			ruleTableName, err := resolveTableName(ctx, conn, rule.TableName)
+			if err != nil {
+				return nil, err
+			}
+			if ruleTableName == "" || ruleTableName != stepTableName {
+				continue
+			}
+		}
+
+		err := rule.validate()
+		if err != nil {
+			return nil, fmt.Errorf("masking: %w", err)
+		}
+		rules[rule.Name] = rule
+	}
+
+	for _, rule := range step.Columns {
+		err := rule.validate()
+		if err != nil {
+			return nil, err
+		}
+		rules[rule.Name] = rule
+	}
+
+	return rules, nil
+}
+
+func describeColumnNames(ctx context.Context, conn *pgconn.PgConn, selectSQL string) ([]string, error) {
+	sd, err := conn.Prepare(ctx, "", selectSQL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error describing select SQL: %w", err)
+	}
+
+	columnNames := make([]string, len(sd.Fields))
+	for i, f := range sd.Fields {
+		columnNames[i] = f.Name
+	}
+	return columnNames, nil
+}
+
+func checkColumnRules(columnNames []string, step *Step, rules map[string]*ColumnRule) (bool, error) {
+	exists := make(map[string]bool, len(columnNames))
+	for _, name := range columnNames {
+		exists[name] = true
+	}
+
+	anyApplied := false
+	for name, rule := range rules {
+		if exists[name] {
+			anyApplied = true
+		} else if rule.TableName != "" || isStepRule(step, rule) {
+			return false, fmt.Errorf("column %s does not exist", name)
+		}
+	}
+
+	return anyApplied, nil
+}
+
+func goColumnTransforms(masking *ConfigMasking, columnNames []string, step *Step, rules map[string]*ColumnRule) ([]goColumnTransform, error) {
+	anyApplied, err := checkColumnRules(columnNames, step, rules)
+	if err != nil || !anyApplied {
+		return nil, err
+	}
+
+	transforms := make([]goColumnTransform, len(columnNames))
+	for i, name := range columnNames {
+		if rule := rules[name]; rule != nil {
+			transforms[i], err = rule.goTransform(masking.Key)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return transforms, nil
+}
+
+func maskedSelectSQL(ctx context.Context, conn *pgconn.PgConn, masking *ConfigMasking, selectSQL string, step *Step, rules map[string]*ColumnRule) (string, error) {
+	if len(rules) == 0 {
+		return selectSQL, nil
+	}
+
+	columnNames, err := describeColumnNames(ctx, conn, selectSQL)
+	if err != nil {
+		return "", err
+	}
+
+	anyApplied, err := checkColumnRules(columnNames, step, rules)
+	if err != nil {
+		return "", err
+	}
+	if !anyApplied {
+		return selectSQL, nil
+	}
+
+	sb := &strings.Builder{}
+	var shuffleCTEs []string
+	sb.WriteString("select ")
+	for i, name := range columnNames {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		ident := pgx.Identifier{name}.Sanitize()
+		rule := rules[name]
+		switch {
+		case rule == nil:
+			sb.WriteString("t.")
+			sb.WriteString(ident)
+		case rule.Transformer == "shuffle":
+			cteName := fmt.Sprintf("shuffle_%d", len(shuffleCTEs))
+			shuffleCTEs = append(shuffleCTEs, fmt.Sprintf(
+				"%s as (select row_number() over (order by random()) as pg_partialcopy_row_number, %s as value from base)",
+				cteName, ident,
+			))
+			fmt.Fprintf(sb, "%s.value as %s", cteName, ident)
+		default:
+			fmt.Fprintf(sb, "%s as %s", rule.sqlExpr("t."+ident), ident)
+		}
+	}
+
+	if len(shuffleCTEs) == 0 {
+		fmt.Fprintf(sb, "\nfrom (%s) t", selectSQL)
+		return sb.String(), nil
+	}
+
+	// Shuffled values are joined back to the rows by position.
+	sb.WriteString("\nfrom numbered t")
+	for i := range shuffleCTEs {
+		fmt.Fprintf(sb, "\n  join shuffle_%d on shuffle_%d.pg_partialcopy_row_number = t.pg_partialcopy_row_number", i, i)
+	}
+
+	return fmt.Sprintf(
+		"with base as (%s),\n  numbered as (select row_number() over () as pg_partialcopy_row_number, base.* from base),\n  %s\n%s",
+		selectSQL, strings.Join(shuffleCTEs, ",\n  "), sb.String(),
+	), nil
+}
+
+func isStepRule(step *Step, rule *ColumnRule) bool {
+	for _, r := range step.Columns {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+func goDigestHex(value []byte, key string) string {
+	if key == "" {
+		sum := md5.Sum(value)
+		return hex.EncodeToString(sum[:])
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(value)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func sqlTextArray(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = quoteLiteral(v)
+	}
+	return "array[" + strings.Join(quoted, ", ") + "]"
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+type fileOutput interface {
+	// writeStep may be called concurrently for different tasks.
+	writeStep(ctx context.Context, sourceConn *pgconn.PgConn, task stepTask, step *Step, plan *stepCopyPlan) error
+
+	finish(structure *sourceStructure) error
+
+	// cleanup is called whether or not finish was called.
+	cleanup() error
+}
+
+type sourceStructure struct {
+	SnapshotID     string
+	PreDataSQL     []byte
+	PostDataSQL    []byte
+	SequenceValues []*sequenceValue
+}
+
+func newFileOutput(config *Config) (fileOutput, error) {
+	switch config.Destination.Type {
+	case "archive":
+		return newArchiveOutput(config.Destination.Path)
+	case "sql":
+		return newSQLScriptOutput(config.Destination.Path)
+	case "csv", "jsonl":
+		return newFlatFileOutput(config.Destination.Path, config.Destination.Type)
+	case "parquet":
+		return newParquetOutput(config.Destination.Path)
+	default:
+		return nil, nil
+	}
+}
+
+func (config *Config) validateDestination() error {
+	switch config.Destination.Type {
+	case "", "database":
+		if config.Destination.DatabaseURL == "" {
+			return fmt.Errorf("destination.database_url is required")
+		}
+		return nil
+	case "archive":
+	case "sql", "csv", "jsonl", "parquet":
+		if config.Format == "binary" {
+			return fmt.Errorf("format binary cannot be used with destination.type %s", config.Destination.Type)
+		}
+		for i, step := range config.Steps {
+			if step.Format == "binary" {
+				return fmt.Errorf("step %d (%s): format binary cannot be used with destination.type %s", i, step.TableName, config.Destination.Type)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown destination.type: %s", config.Destination.Type)
+	}
+
+	if config.Destination.Path == "" {
+		return fmt.Errorf("destination.path is required for destination.type %s", config.Destination.Type)
+	}
+	if config.refresh() {
+		return fmt.Errorf("destination.mode refresh cannot be used with destination.type %s", config.Destination.Type)
+	}
+	if config.Resume {
+		return fmt.Errorf("resume cannot be used with destination.type %s", config.Destination.Type)
+	}
+
+	return nil
+}
@@ -0,0 +1,882 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	parquetBoolean   = 0
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetFloat     = 4
+	parquetDouble    = 5
+	parquetByteArray = 6
+)
+
+const (
+	parquetConvertedUTF8            = 0
+	parquetConvertedList            = 3
+	parquetConvertedDecimal         = 5
+	parquetConvertedDate            = 6
+	parquetConvertedTimestampMicros = 10
+	parquetConvertedInt16           = 16
+)
+
+const (
+	parquetRepetitionOptional = 1
+	parquetRepetitionRepeated = 2
+
+	parquetEncodingPlain = 0
+	parquetEncodingRLE   = 3
+)
+
+const (
+	parquetRowGroupRows  = 100_000
+	parquetRowGroupBytes = 64 * 1024 * 1024
+)
+
+var parquetMagic = []byte("PAR1")
+
+type parquetKind int
+
+const (
+	parquetKindString parquetKind = iota
+	parquetKindBytes
+	parquetKindBool
+	parquetKindInt16
+	parquetKindInt32
+	parquetKindInt64
+	parquetKindFloat
+	parquetKindDouble
+	parquetKindDecimal
+	parquetKindDate
+	parquetKindTimestamp
+	parquetKindTimestampTZ
+)
+
+type parquetColumn struct {
+	name      string
+	kind      parquetKind
+	list      bool
+	scale     int32
+	precision int32
+}
+
+func parquetColumns(ctx context.Context, conn *pgconn.PgConn, fields []pgconn.FieldDescription) ([]*parquetColumn, error) {
+	oids := make([]string, len(fields))
+	for i, f := range fields {
+		oids[i] = strconv.FormatUint(uint64(f.DataTypeOID), 10)
+	}
+	result := conn.ExecParams(ctx,
+		"select oid::int8, typelem::int8 from pg_type where typcategory = 'A' and oid = any($1::oid[])",
+		[][]byte{[]byte("{" + strings.Join(oids, ",") + "}")}, nil, nil, nil,
+	).Read()
+	if result.Err != nil {
+		return nil, fmt.Errorf("error getting array element types: %w", result.Err)
+	}
+	elementOIDs := make(map[uint32]uint32, len(result.Rows))
+	for _, row := range result.Rows {
+		oid, err := strconv.ParseUint(string(row[0]), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		elementOID, err := strconv.ParseUint(string(row[1]), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		elementOIDs[uint32(oid)] = uint32(elementOID)
+	}
+
+	columns := make([]*parquetColumn, len(fields))
+	for i, f := range fields {
+		c := &parquetColumn{name: f.Name}
+		oid := f.DataTypeOID
+		if elementOID, ok := elementOIDs[oid]; ok {
+			c.list = true
+			oid = elementOID
+		}
+
+		switch oid {
+		case pgtype.BoolOID:
+			c.kind = parquetKindBool
+		case pgtype.Int2OID:
+			c.kind = parquetKindInt16
+		case pgtype.Int4OID:
+			c.kind = parquetKindInt32
+		case pgtype.Int8OID, pgtype.OIDOID:
+			c.kind = parquetKindInt64
+		case pgtype.Float4OID:
+			c.kind = parquetKindFloat
+		case pgtype.Float8OID:
+			c.kind = parquetKindDouble
+		case pgtype.NumericOID:
+			// A numeric without a declared precision and scale can have any scale so it is written as a string.
+			if f.TypeModifier >= 4 {
+				precision := (f.TypeModifier - 4) >> 16 & 0xffff
+				scale := (f.TypeModifier - 4) & 0xffff
+				if scale <= precision {
+					c.kind = parquetKindDecimal
+					c.precision = precision
+					c.scale = scale
+				}
+			}
+		case pgtype.DateOID:
+			c.kind = parquetKindDate
+		case pgtype.TimestampOID:
+			c.kind = parquetKindTimestamp
+		case pgtype.TimestamptzOID:
+			c.kind = parquetKindTimestampTZ
+		case pgtype.ByteaOID:
+			c.kind = parquetKindBytes
+		}
+
+		columns[i] = c
+	}
+
+	return columns, nil
+}
+
+func (c *parquetColumn) physicalType() int32 {
+	switch c.kind {
+	case parquetKindBool:
+		return parquetBoolean
+	case parquetKindInt16, parquetKindInt32, parquetKindDate:
+		return parquetInt32
+	case parquetKindInt64, parquetKindTimestamp, parquetKindTimestampTZ:
+		return parquetInt64
+	case parquetKindFloat:
+		return parquetFloat
+	case parquetKindDouble:
+		return parquetDouble
+	default:
+		return parquetByteArray
+	}
+}
+
+func (c *parquetColumn) path() []string {
+	if c.list {
+		return []string{c.name, "list", "element"}
+	}
+	return []string{c.name}
+}
+
+func (c *parquetColumn) writeSchemaElements(tw *thriftWriter) {
+	name := c.name
+	if c.list {
+		tw.beginStruct()
+		tw.i32Field(3, parquetRepetitionOptional)
+		tw.stringField(4, c.name)
+		tw.i32Field(5, 1)
+		tw.i32Field(6, parquetConvertedList)
+		tw.structField(10)
+		tw.structField(3)
+		tw.endStruct()
+		tw.endStruct()
+		tw.endStruct()
+
+		tw.beginStruct()
+		tw.i32Field(3, parquetRepetitionRepeated)
+		tw.stringField(4, "list")
+		tw.i32Field(5, 1)
+		tw.endStruct()
+
+		name = "element"
+	}
+
+	tw.beginStruct()
+	tw.i32Field(1, c.physicalType())
+	tw.i32Field(3, parquetRepetitionOptional)
+	tw.stringField(4, name)
+	switch c.kind {
+	case parquetKindString:
+		tw.i32Field(6, parquetConvertedUTF8)
+		tw.structField(10)
+		tw.structField(1)
+		tw.endStruct()
+		tw.endStruct()
+	case parquetKindInt16:
+		tw.i32Field(6, parquetConvertedInt16)
+	case parquetKindDecimal:
+		tw.i32Field(6, parquetConvertedDecimal)
+		tw.i32Field(7, c.scale)
+		tw.i32Field(8, c.precision)
+		tw.structField(10)
+		tw.structField(5)
+		tw.i32Field(1, c.scale)
+		tw.i32Field(2, c.precision)
+		tw.endStruct()
+		tw.endStruct()
+	case parquetKindDate:
+		tw.i32Field(6, parquetConvertedDate)
+		tw.structField(10)
+		tw.structField(6)
+		tw.endStruct()
+		tw.endStruct()
+	case parquetKindTimestamp, parquetKindTimestampTZ:
+		if c.kind == parquetKindTimestampTZ {
+			tw.i32Field(6, parquetConvertedTimestampMicros)
+		}
+		tw.structField(10)
+		tw.structField(8)
+		tw.boolField(1, c.kind == parquetKindTimestampTZ)
+		tw.structField(2)
+		tw.structField(2)
+		tw.endStruct()
+		tw.endStruct()
+		tw.endStruct()
+		tw.endStruct()
+	}
+	tw.endStruct()
+}
+
+func (c *parquetColumn) schemaElementCount() int {
+	if c.list {
+		return 3
+	}
+	return 1
+}
+
+type parquetColumnBuffer struct {
+	repetitionLevels []byte
+	definitionLevels []byte
+	values           []byte
+	bools            []bool
+}
+
+func (c *parquetColumn) appendValue(b *parquetColumnBuffer, value []byte) error {
+	if !c.list {
+		if value == nil {
+			b.definitionLevels = append(b.definitionLevels, 0)
+			return nil
+		}
+		b.definitionLevels = append(b.definitionLevels, 1)
+		return c.appendLeafValue(b, value)
+	}
+
+	if value == nil {
+		b.repetitionLevels = append(b.repetitionLevels, 0)
+		b.definitionLevels = append(b.definitionLevels, 0)
+		return nil
+	}
+
+	elements, err := parseArrayText(value)
+	if err != nil {
+		return fmt.Errorf("column %s: %w", c.name, err)
+	}
+	if len(elements) == 0 {
+		b.repetitionLevels = append(b.repetitionLevels, 0)
+		b.definitionLevels = append(b.definitionLevels, 1)
+		return nil
+	}
+	for i, element := range elements {
+		b.repetitionLevels = append(b.repetitionLevels, min(byte(i), 1))
+		if element == nil {
+			b.definitionLevels = append(b.definitionLevels, 2)
+			continue
+		}
+		b.definitionLevels = append(b.definitionLevels, 3)
+		err := c.appendLeafValue(b, element)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *parquetColumn) appendLeafValue(b *parquetColumnBuffer, value []byte) error {
+	s := string(value)
+	var err error
+	switch c.kind {
+	case parquetKindString:
+		b.values = binary.LittleEndian.AppendUint32(b.values, uint32(len(value)))
+		b.values = append(b.values, value...)
+	case parquetKindBytes:
+		hexValue, found := strings.CutPrefix(s, `\x`)
+		if !found {
+			return fmt.Errorf("column %s: bytea is not in the hex format", c.name)
+		}
+		var decoded []byte
+		decoded, err = hex.DecodeString(hexValue)
+		b.values = binary.LittleEndian.AppendUint32(b.values, uint32(len(decoded)))
+		b.values = append(b.values, decoded...)
+	case parquetKindBool:
+		b.bools = append(b.bools, s == "t")
+	case parquetKindInt16, parquetKindInt32:
+		var n int64
+		n, err = strconv.ParseInt(s, 10, 32)
+		b.values = binary.LittleEndian.AppendUint32(b.values, uint32(int32(n)))
+	case parquetKindInt64:
+		var n int64
+		n, err = strconv.ParseInt(s, 10, 64)
+		b.values = binary.LittleEndian.AppendUint64(b.values, uint64(n))
+	case parquetKindFloat:
+		var f float64
+		f, err = strconv.ParseFloat(s, 32)
+		b.values = binary.LittleEndian.AppendUint32(b.values, math.Float32bits(float32(f)))
+	case parquetKindDouble:
+		var f float64
+		f, err = strconv.ParseFloat(s, 64)
+		b.values = binary.LittleEndian.AppendUint64(b.values, math.Float64bits(f))
+	case parquetKindDecimal:
+		var unscaled []byte
+		unscaled, err = parseDecimalText(s, c.scale)
+		b.values = binary.LittleEndian.AppendUint32(b.values, uint32(len(unscaled)))
+		b.values = append(b.values, unscaled...)
+	case parquetKindDate:
+		var days int32
+		days, err = parseDateText(s)
+		b.values = binary.LittleEndian.AppendUint32(b.values, uint32(days))
+	case parquetKindTimestamp, parquetKindTimestampTZ:
+		var micros int64
+		micros, err = parseTimestampText(s, c.kind == parquetKindTimestampTZ)
+		b.values = binary.LittleEndian.AppendUint64(b.values, uint64(micros))
+	}
+	if err != nil {
+		return fmt.Errorf("column %s: %w", c.name, err)
+	}
+
+	return nil
+}
+
+func (c *parquetColumn) appendPage(buf []byte, b *parquetColumnBuffer) []byte {
+	if c.list {
+		buf = appendRLELevels(buf, b.repetitionLevels)
+	}
+	buf = appendRLELevels(buf, b.definitionLevels)
+
+	if c.kind == parquetKindBool {
+		packed := make([]byte, (len(b.bools)+7)/8)
+		for i, v := range b.bools {
+			if v {
+				packed[i/8] |= 1 << (i % 8)
+			}
+		}
+		return append(buf, packed...)
+	}
+	return append(buf, b.values...)
+}
+
+func appendRLELevels(buf []byte, levels []byte) []byte {
+	start := len(buf)
+	buf = append(buf, 0, 0, 0, 0)
+	for i := 0; i < len(levels); {
+		j := i + 1
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		buf = binary.AppendUvarint(buf, uint64(j-i)<<1)
+		buf = append(buf, levels[i])
+		i = j
+	}
+	binary.LittleEndian.PutUint32(buf[start:], uint32(len(buf)-start-4))
+	return buf
+}
+
+func parseArrayText(value []byte) ([][]byte, error) {
+	// An array with bounds other than the default is prefixed with its dimensions. e.g. [0:1]={1,2}
+	if len(value) > 0 && value[0] == '[' {
+		idx := bytes.IndexByte(value, '=')
+		if idx == -1 {
+			return nil, fmt.Errorf("invalid array: %s", value)
+		}
+		value = value[idx+1:]
+	}
+
+	var elements [][]byte
+	for i := 0; i < len(value); {
+		switch value[i] {
+		case '{', '}', ',', ' ':
+			i++
+		case '"':
+			element := []byte{}
+			for i++; i < len(value) && value[i] != '"'; i++ {
+				if value[i] == '\\' {
+					i++
+					if i == len(value) {
+						break
+					}
+				}
+				element = append(element, value[i])
+			}
+			if i >= len(value) {
+				return nil, fmt.Errorf("invalid array: %s", value)
+			}
+			i++
+			elements = append(elements, element)
+		default:
+			j := i
+			for j < len(value) && value[j] != ',' && value[j] != '}' {
+				j++
+			}
+			element := bytes.TrimSpace(value[i:j])
+			if strings.EqualFold(string(element), "NULL") {
+				elements = append(elements, nil)
+			} else {
+				elements = append(elements, bytes.Clone(element))
+			}
+			i = j
+		}
+	}
+
+	return elements, nil
+}
+
+func parseDecimalText(s string, scale int32) ([]byte, error) {
+	intPart, fracPart, _ := strings.Cut(s, ".")
+	if len(fracPart) > int(scale) {
+		return nil, fmt.Errorf("numeric %s has more than %d digits after the decimal point", s, scale)
+	}
+	n, ok := new(big.Int).SetString(intPart+fracPart+strings.Repeat("0", int(scale)-len(fracPart)), 10)
+	if !ok {
+		return nil, fmt.Errorf("numeric %s cannot be written as a decimal", s)
+	}
+
+	if n.Sign() >= 0 {
+		b := n.Bytes()
+		if len(b) == 0 || b[0]&0x80 != 0 {
+			b = append([]byte{0}, b...)
+		}
+		return b, nil
+	}
+
+	// The magnitude of the most negative value of a size is one more than the most positive value.
+	size := new(big.Int).Not(n).BitLen()/8 + 1
+	twosComplement := new(big.Int).Lsh(big.NewInt(1), uint(size*8))
+	twosComplement.Add(twosComplement, n)
+	return twosComplement.FillBytes(make([]byte, size)), nil
+}
+
+func parseDateText(s string) (int32, error) {
+	switch s {
+	case "infinity":
+		return math.MaxInt32, nil
+	case "-infinity":
+		return math.MinInt32, nil
+	}
+
+	t, err := parseISOTime(s, "01-02")
+	if err != nil {
+		return 0, err
+	}
+	return int32(t.Unix() / 86400), nil
+}
+
+func parseTimestampText(s string, withTimeZone bool) (int64, error) {
+	switch s {
+	case "infinity":
+		return math.MaxInt64, nil
+	case "-infinity":
+		return math.MinInt64, nil
+	}
+
+	layouts := []string{"01-02 15:04:05"}
+	if withTimeZone {
+		// The offset has minutes and seconds only when they are not zero.
+		layouts = []string{"01-02 15:04:05-07", "01-02 15:04:05-07:00", "01-02 15:04:05-07:00:00"}
+	}
+
+	var t time.Time
+	var err error
+	for _, layout := range layouts {
+		t, err = parseISOTime(s, layout)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// PostgreSQL timestamps are relative to 2000 so the last years it supports cannot be relative to the Unix epoch.
+	if sec := t.Unix(); sec > math.MaxInt64/1_000_000-1 || sec < math.MinInt64/1_000_000+1 {
+		return 0, fmt.Errorf("timestamp out of range: %s", s)
+	}
+	return t.UnixMicro(), nil
+}
+
+func parseISOTime(s, layout string) (time.Time, error) {
+	value, bc := strings.CutSuffix(s, " BC")
+	yearText, rest, ok := strings.Cut(value, "-")
+	year, err := strconv.Atoi(yearText)
+	if !ok || err != nil || len(yearText) < 4 || year < 1 {
+		return time.Time{}, fmt.Errorf("invalid date: %s", s)
+	}
+	if bc {
+		// There is no year 0, so 1 BC is year 0 of the proleptic Gregorian calendar.
+		year = 1 - year
+	}
+
+	// The rest is parsed in a leap year so February 29 is accepted. It is checked against year afterward.
+	t, err := time.Parse("2006-"+layout, "2000-"+rest)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date: %s: %w", s, err)
+	}
+	date := time.Date(year, t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	if date.Day() != t.Day() {
+		return time.Time{}, fmt.Errorf("invalid date: %s", s)
+	}
+	return date, nil
+}
+
+type parquetRowGroup struct {
+	numRows int64
+	chunks  []*parquetColumnChunk
+}
+
+type parquetColumnChunk struct {
+	offset    int64
+	size      int64
+	numValues int64
+}
+
+type parquetRowGroupWriter struct {
+	w             io.Writer
+	offset        int64
+	columns       []*parquetColumn
+	buffers       []*parquetColumnBuffer
+	rowCount      int
+	bufferedBytes int
+	rowGroups     []*parquetRowGroup
+}
+
+func newParquetRowGroupWriter(w io.Writer, columns []*parquetColumn) *parquetRowGroupWriter {
+	rw := &parquetRowGroupWriter{w: w, columns: columns, buffers: make([]*parquetColumnBuffer, len(columns))}
+	for i := range rw.buffers {
+		rw.buffers[i] = &parquetColumnBuffer{}
+	}
+	return rw
+}
+
+func (rw *parquetRowGroupWriter) writeRow(values [][]byte) error {
+	for i, c := range rw.columns {
+		err := c.appendValue(rw.buffers[i], values[i])
+		if err != nil {
+			return err
+		}
+		rw.bufferedBytes += len(values[i])
+	}
+	rw.rowCount++
+
+	if rw.rowCount >= parquetRowGroupRows || rw.bufferedBytes >= parquetRowGroupBytes {
+		return rw.flush()
+	}
+	return nil
+}
+
+func (rw *parquetRowGroupWriter) flush() error {
+	if rw.rowCount == 0 {
+		return nil
+	}
+
+	rg := &parquetRowGroup{numRows: int64(rw.rowCount)}
+	var page []byte
+	for i, c := range rw.columns {
+		b := rw.buffers[i]
+		page = c.appendPage(page[:0], b)
+		numValues := len(b.definitionLevels)
+
+		tw := &thriftWriter{}
+		tw.beginStruct()
+		tw.i32Field(1, 0) // DATA_PAGE
+		tw.i32Field(2, int32(len(page)))
+		tw.i32Field(3, int32(len(page)))
+		tw.structField(5)
+		tw.i32Field(1, int32(numValues))
+		tw.i32Field(2, parquetEncodingPlain)
+		tw.i32Field(3, parquetEncodingRLE)
+		tw.i32Field(4, parquetEncodingRLE)
+		tw.endStruct()
+		tw.endStruct()
+
+		for _, buf := range [][]byte{tw.buf, page} {
+			_, err := rw.w.Write(buf)
+			if err != nil {
+				return err
+			}
+		}
+
+		size := int64(len(tw.buf) + len(page))
+		rg.chunks = append(rg.chunks, &parquetColumnChunk{offset: rw.offset, size: size, numValues: int64(numValues)})
+		rw.offset += size
+		rw.buffers[i] = &parquetColumnBuffer{}
+	}
+
+	rw.rowGroups = append(rw.rowGroups, rg)
+	rw.rowCount = 0
+	rw.bufferedBytes = 0
+
+	return nil
+}
+
+type parquetFile struct {
+	path      string
+	columns   []*parquetColumn
+	mux       sync.Mutex
+	file      *os.File
+	offset    int64
+	rowGroups []*parquetRowGroup
+}
+
+func createParquetFile(path string, columns []*parquetColumn) (*parquetFile, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = file.Write(parquetMagic)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &parquetFile{path: path, columns: columns, file: file, offset: int64(len(parquetMagic))}, nil
+}
+
+func (pf *parquetFile) appendRowGroups(rowGroupsPath string, rowGroups []*parquetRowGroup) error {
+	pf.mux.Lock()
+	defer pf.mux.Unlock()
+
+	rowGroupsFile, err := os.Open(rowGroupsPath)
+	if err != nil {
+		return err
+	}
+	defer rowGroupsFile.Close()
+
+	n, err := io.Copy(pf.file, rowGroupsFile)
+	if err != nil {
+		return err
+	}
+
+	for _, rg := range rowGroups {
+		for _, chunk := range rg.chunks {
+			chunk.offset += pf.offset
+		}
+		pf.rowGroups = append(pf.rowGroups, rg)
+	}
+	pf.offset += n
+
+	return nil
+}
+
+func (pf *parquetFile) close() error {
+	pf.mux.Lock()
+	defer pf.mux.Unlock()
+
+	var numRows int64
+	for _, rg := range pf.rowGroups {
+		numRows += rg.numRows
+	}
+
+	schemaElementCount := 1
+	for _, c := range pf.columns {
+		schemaElementCount += c.schemaElementCount()
+	}
+
+	tw := &thriftWriter{}
+	tw.beginStruct()
+	tw.i32Field(1, 1)
+	tw.listField(2, thriftStruct, schemaElementCount)
+	tw.beginStruct()
+	tw.stringField(4, "schema")
+	tw.i32Field(5, int32(len(pf.columns)))
+	tw.endStruct()
+	for _, c := range pf.columns {
+		c.writeSchemaElements(tw)
+	}
+	tw.i64Field(3, numRows)
+	tw.listField(4, thriftStruct, len(pf.rowGroups))
+	for _, rg := range pf.rowGroups {
+		var totalByteSize int64
+		tw.beginStruct()
+		tw.listField(1, thriftStruct, len(rg.chunks))
+		for i, chunk := range rg.chunks {
+			c := pf.columns[i]
+			tw.beginStruct()
+			tw.i64Field(2, chunk.offset)
+			tw.structField(3)
+			tw.i32Field(1, c.physicalType())
+			tw.i32ListField(2, []int32{parquetEncodingPlain, parquetEncodingRLE})
+			tw.stringListField(3, c.path())
+			tw.i32Field(4, 0) // UNCOMPRESSED
+			tw.i64Field(5, chunk.numValues)
+			tw.i64Field(6, chunk.size)
+			tw.i64Field(7, chunk.size)
+			tw.i64Field(9, chunk.offset)
+			tw.endStruct()
+			tw.endStruct()
+			totalByteSize += chunk.size
+		}
+		tw.i64Field(2, totalByteSize)
+		tw.i64Field(3, rg.numRows)
+		tw.endStruct()
+	}
+	tw.stringField(6, "pg_partialcopy")
+	tw.endStruct()
+
+	footer := binary.LittleEndian.AppendUint32(tw.buf, uint32(len(tw.buf)))
+	footer = append(footer, parquetMagic...)
+	_, err := pf.file.Write(footer)
+	if err == nil {
+		err = pf.file.Close()
+	} else {
+		pf.file.Close()
+	}
+	pf.file = nil
+	return err
+}
+
+type parquetOutput struct {
+	dir     string
+	tempDir string
+	mux     sync.Mutex
+	files   map[int]*parquetFile
+}
+
+func newParquetOutput(dir string) (*parquetOutput, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating output directory: %w", err)
+	}
+
+	tempDir, err := os.MkdirTemp(dir, ".pg_partialcopy-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary directory: %w", err)
+	}
+
+	return &parquetOutput{dir: dir, tempDir: tempDir, files: make(map[int]*parquetFile)}, nil
+}
+
+func (o *parquetOutput) writeStep(ctx context.Context, sourceConn *pgconn.PgConn, task stepTask, step *Step, plan *stepCopyPlan) error {
+	// Dates, timestamps, and bytea are parsed from the text format. Rolling back the savepoint restores the settings.
+	err := sourceConn.Exec(ctx, "savepoint parquet_write_step; set local datestyle = 'ISO, MDY'; set local bytea_output = 'hex'").Close()
+	if err != nil {
+		return err
+	}
+
+	err = o.writeStepRows(ctx, sourceConn, task, step, plan)
+	rollbackErr := sourceConn.Exec(ctx, "rollback to savepoint parquet_write_step; release savepoint parquet_write_step").Close()
+	if err != nil {
+		return err
+	}
+	return rollbackErr
+}
+
+func (o *parquetOutput) writeStepRows(ctx context.Context, sourceConn *pgconn.PgConn, task stepTask, step *Step, plan *stepCopyPlan) error {
+	sd, err := sourceConn.Prepare(ctx, "", plan.SelectSQL, nil)
+	if err != nil {
+		return fmt.Errorf("error describing select SQL: %w", err)
+	}
+	columns, err := parquetColumns(ctx, sourceConn, sd.Fields)
+	if err != nil {
+		return err
+	}
+
+	rowGroupsPath := filepath.Join(o.tempDir, fmt.Sprintf("%d.%d.parquet", task.stepIdx, task.chunkIdx))
+	defer os.Remove(rowGroupsPath)
+	var rowGroups []*parquetRowGroup
+	err = writeFile(rowGroupsPath, func(w io.Writer) error {
+		bw := bufio.NewWriterSize(w, 64*1024)
+		rw := newParquetRowGroupWriter(bw, columns)
+
+		r, pw := io.Pipe()
+		g := &errgroup.Group{}
+		g.Go(func() error {
+			defer pw.Close()
+
+			_, err := writeRows(ctx, sourceConn, pw, plan)
+			if err != nil {
+				pw.CloseWithError(err)
+				return err
+			}
+
+			return nil
+		})
+
+		g.Go(func() error {
+			err := readCopyText(r, len(columns), rw.writeRow)
+			if err == nil {
+				err = rw.flush()
+			}
+			if err != nil {
+				r.CloseWithError(err)
+				return err
+			}
+
+			return bw.Flush()
+		})
+
+		err := g.Wait()
+		rowGroups = rw.rowGroups
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	pf, err := o.file(task.stepIdx, step.TableName, columns)
+	if err != nil {
+		return err
+	}
+	return pf.appendRowGroups(rowGroupsPath, rowGroups)
+}
+
+func (o *parquetOutput) file(stepIdx int, tableName string, columns []*parquetColumn) (*parquetFile, error) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	if pf := o.files[stepIdx]; pf != nil {
+		return pf, nil
+	}
+
+	path := filepath.Join(o.dir, flatFileName(tableName)+".parquet")
+	pf, err := createParquetFile(path, columns)
+	if err != nil {
+		return nil, fmt.Errorf("error creating %s: %w", path, err)
+	}
+	o.files[stepIdx] = pf
+	return pf, nil
+}
+
+func (o *parquetOutput) finish(structure *sourceStructure) error {
+	for _, stepIdx := range slices.Sorted(maps.Keys(o.files)) {
+		pf := o.files[stepIdx]
+		err := pf.close()
+		if err != nil {
+			return fmt.Errorf("error writing %s: %w", pf.path, err)
+		}
+	}
+	slog.Info("Wrote files", "dir", o.dir, "format", "parquet")
+
+	return nil
+}
+
+func (o *parquetOutput) cleanup() error {
+	for _, pf := range o.files {
+		if pf.file != nil {
+			pf.file.Close()
+		}
+	}
+	return os.RemoveAll(o.tempDir)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseArrayText(t *testing.T) {
+	for _, tt := range []struct {
+		value    string
+		expected [][]byte
+	}{
+		{value: "{}", expected: nil},
+		{value: "{1,2,3}", expected: [][]byte{[]byte("1"), []byte("2"), []byte("3")}},
+		{value: `{a,NULL,"NULL","b \"c\", d",""}`, expected: [][]byte{[]byte("a"), nil, []byte("NULL"), []byte(`b "c", d`), {}}},
+		{value: "{{1,2},{3,4}}", expected: [][]byte{[]byte("1"), []byte("2"), []byte("3"), []byte("4")}},
+		{value: "[0:1]={5,6}", expected: [][]byte{[]byte("5"), []byte("6")}},
+	} {
+		elements, err := parseArrayText([]byte(tt.value))
+		require.NoError(t, err, tt.value)
+		require.Equal(t, tt.expected, elements, tt.value)
+	}
+
+	_, err := parseArrayText([]byte(`{"unterminated}`))
+	require.Error(t, err)
+}
+
+func TestParseDecimalText(t *testing.T) {
+	for _, tt := range []struct {
+		value    string
+		scale    int32
+		expected []byte
+	}{
+		{value: "0", scale: 2, expected: []byte{0x00}},
+		{value: "1.5", scale: 2, expected: []byte{0x00, 0x96}},
+		{value: "-1.50", scale: 2, expected: []byte{0xff, 0x6a}},
+		{value: "-128", scale: 0, expected: []byte{0x80}},
+		{value: "12345.67", scale: 2, expected: []byte{0x12, 0xd6, 0x87}},
+	} {
+		b, err := parseDecimalText(tt.value, tt.scale)
+		require.NoError(t, err, tt.value)
+		require.Equal(t, tt.expected, b, tt.value)
+	}
+
+	_, err := parseDecimalText("1.234", 2)
+	require.Error(t, err)
+	_, err = parseDecimalText("NaN", 2)
+	require.Error(t, err)
+}
+
+func TestParseTimestampText(t *testing.T) {
+	days, err := parseDateText("1970-01-02")
+	require.NoError(t, err)
+	require.EqualValues(t, 1, days)
+
+	micros, err := parseTimestampText("1970-01-01 00:00:01.5", false)
+	require.NoError(t, err)
+	require.EqualValues(t, 1_500_000, micros)
+
+	for _, s := range []string{"1970-01-01 02:00:00+02", "1970-01-01 02:30:00+02:30", "1969-12-31 19:00:00-05"} {
+		micros, err := parseTimestampText(s, true)
+		require.NoError(t, err, s)
+		require.EqualValues(t, 0, micros, s)
+	}
+
+	// 0001-03-01 BC is 719468 days before the Unix epoch and 10000-01-01 is 2932897 days after it.
+	for _, tt := range []struct {
+		value    string
+		expected int32
+	}{
+		{value: "0001-03-01 BC", expected: -719468},
+		{value: "0001-02-29 BC", expected: -719469},
+		{value: "10000-01-01", expected: 2932897},
+	} {
+		days, err := parseDateText(tt.value)
+		require.NoError(t, err, tt.value)
+		require.EqualValues(t, tt.expected, days, tt.value)
+	}
+
+	for _, tt := range []struct {
+		value        string
+		withTimeZone bool
+		expected     int64
+	}{
+		{value: "0001-03-01 00:00:00.5 BC", expected: -719468*86_400_000_000 + 500_000},
+		{value: "0001-03-01 00:53:28+00:53:28 BC", withTimeZone: true, expected: -719468 * 86_400_000_000},
+		{value: "10000-01-01 00:00:00", expected: 2932897 * 86_400_000_000},
+		{value: "10000-01-01 01:00:00+01", withTimeZone: true, expected: 2932897 * 86_400_000_000},
+	} {
+		micros, err := parseTimestampText(tt.value, tt.withTimeZone)
+		require.NoError(t, err, tt.value)
+		require.EqualValues(t, tt.expected, micros, tt.value)
+	}
+
+	for _, s := range []string{"1900-02-29", "0000-01-01", "123-01-01", "2020-13-01"} {
+		_, err := parseDateText(s)
+		require.Error(t, err, s)
+	}
+	_, err = parseTimestampText("294270-01-01 00:00:00", false)
+	require.EqualError(t, err, "timestamp out of range: 294270-01-01 00:00:00")
+}
+
+func TestParquetFile(t *testing.T) {
+	columns := []*parquetColumn{
+		{name: "id", kind: parquetKindInt64},
+		{name: "name", kind: parquetKindString},
+		{name: "active", kind: parquetKindBool},
+		{name: "tags", kind: parquetKindString, list: true},
+	}
+	path := filepath.Join(t.TempDir(), "test.parquet")
+	pf, err := createParquetFile(path, columns)
+	require.NoError(t, err)
+
+	rowGroupsPath := filepath.Join(t.TempDir(), "row_groups")
+	buf := &bytes.Buffer{}
+	rw := newParquetRowGroupWriter(buf, columns)
+	err = readCopyText(strings.NewReader("1\tMoe\tt\t{a,b}\n2\t\\N\tf\t{}\n3\tLarry\t\\N\t\\N\n"), len(columns), rw.writeRow)
+	require.NoError(t, err)
+	require.NoError(t, rw.flush())
+	require.NoError(t, os.WriteFile(rowGroupsPath, buf.Bytes(), 0644))
+	require.NoError(t, pf.appendRowGroups(rowGroupsPath, rw.rowGroups))
+	require.NoError(t, pf.close())
+
+	require.Len(t, rw.rowGroups, 1)
+	require.EqualValues(t, 3, rw.rowGroups[0].numRows)
+	require.EqualValues(t, []int64{3, 3, 3, 4}, []int64{
+		rw.rowGroups[0].chunks[0].numValues,
+		rw.rowGroups[0].chunks[1].numValues,
+		rw.rowGroups[0].chunks[2].numValues,
+		rw.rowGroups[0].chunks[3].numValues,
+	})
+	require.EqualValues(t, 4, rw.rowGroups[0].chunks[0].offset)
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "PAR1", string(b[:4]))
+	require.Equal(t, "PAR1", string(b[len(b)-4:]))
+	footerLen := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	require.Equal(t, len(buf.Bytes())+4, len(b)-8-footerLen)
+	require.Contains(t, string(b[len(b)-8-footerLen:]), "pg_partialcopy")
+}
+
+// Run with UPDATE_FIXTURES=1 to rewrite testdata/all_types.parquet and check it with an independent reader.
+func TestParquetFileFixture(t *testing.T) {
+	columns := []*parquetColumn{
+		{name: "id", kind: parquetKindInt64},
+		{name: "name", kind: parquetKindString},
+		{name: "active", kind: parquetKindBool},
+		{name: "amount", kind: parquetKindDecimal, precision: 10, scale: 2},
+		{name: "day", kind: parquetKindDate},
+		{name: "at", kind: parquetKindTimestampTZ},
+		{name: "score", kind: parquetKindDouble},
+		{name: "data", kind: parquetKindBytes},
+		{name: "tags", kind: parquetKindString, list: true},
+	}
+	copyText := "1\tMoe\tt\t12.50\t0044-03-15 BC\t10000-01-01 01:00:00+01\t1.5\t\\\\x0102\t{a,NULL}\n" +
+		"2\t\\N\tf\t-1.00\t1970-01-02\t1970-01-01 00:00:01.5+00\t\\N\t\\N\t{}\n" +
+		"3\tLarry\t\\N\t\\N\t\\N\t\\N\t-2\t\\\\x\t\\N\n"
+
+	path := filepath.Join(t.TempDir(), "all_types.parquet")
+	pf, err := createParquetFile(path, columns)
+	require.NoError(t, err)
+
+	rowGroupsPath := filepath.Join(t.TempDir(), "row_groups")
+	buf := &bytes.Buffer{}
+	rw := newParquetRowGroupWriter(buf, columns)
+	err = readCopyText(strings.NewReader(copyText), len(columns), rw.writeRow)
+	require.NoError(t, err)
+	require.NoError(t, rw.flush())
+	require.NoError(t, os.WriteFile(rowGroupsPath, buf.Bytes(), 0644))
+	require.NoError(t, pf.appendRowGroups(rowGroupsPath, rw.rowGroups))
+	require.NoError(t, pf.close())
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	fixturePath := filepath.Join("testdata", "all_types.parquet")
+	if os.Getenv("UPDATE_FIXTURES") != "" {
+		require.NoError(t, os.WriteFile(fixturePath, b, 0644))
+	}
+	fixture, err := os.ReadFile(fixturePath)
+	require.NoError(t, err)
+	require.Equal(t, fixture, b)
+}
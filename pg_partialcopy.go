@@ -8,8 +8,10 @@ import (
 	"log/slog"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/jackc/pgx/v5"
@@ -25,9 +27,24 @@ import (
 )
 
 type Config struct {
-	Source      ConfigSource      `toml:"source"`
-	Destination ConfigDestination `toml:"destination"`
-	Steps       []*Step           `toml:"steps"`
+	Parallelism    int               `toml:"parallelism"`
+	CheckpointFile string            `toml:"checkpoint_file"`
+	CheckDrift     bool              `toml:"check_drift"`
+	Format         string            `toml:"format"`
+	Source         ConfigSource      `toml:"source"`
+	Destination    ConfigDestination `toml:"destination"`
+	Masking        ConfigMasking     `toml:"masking"`
+	Steps          []*Step           `toml:"steps"`
+	OnFKViolation  string            `toml:"on_fk_violation"`
+	Verify         string            `toml:"verify"`
+	Resume         bool              `toml:"-"`
+	ReportFile     string            `toml:"-"`
+	OnlyPatterns   []string          `toml:"-"`
+	SkipPatterns   []string          `toml:"-"`
+
+	undecodedKeys []string
+	output        fileOutput
+	report        *runReport
 }
 
 type ConfigSource struct {
@@ -36,17 +53,40 @@ type ConfigSource struct {
 }
 
 type ConfigDestination struct {
+	Type           string `toml:"type"`
+	Path           string `toml:"path"`
 	PrepareCommand string `toml:"prepare_command"`
 	DatabaseURL    string `toml:"database_url"`
+	Mode           string `toml:"mode"`
 }
 
 type Step struct {
-	TableName     string `toml:"table_name"`
-	SelectSQL     string `toml:"select_sql"`
-	BeforeCopySQL string `toml:"before_copy_sql"`
-	AfterCopySQL  string `toml:"after_copy_sql"`
+	TableName       string        `toml:"table_name"`
+	SelectSQL       string        `toml:"select_sql"`
+	Where           string        `toml:"where"`
+	IncludeChildren bool          `toml:"include_children"`
+	BeforeCopySQL   string        `toml:"before_copy_sql"`
+	AfterCopySQL    string        `toml:"after_copy_sql"`
+	Format          string        `toml:"format"`
+	ChunkBy         string        `toml:"chunk_by"`
+	ChunkSize       int64         `toml:"chunk_size"`
+	ChunkRetries    int           `toml:"chunk_retries"`
+	Refresh         string        `toml:"refresh"`
+	ColumnNames     []string      `toml:"column_names"`
+	Columns         []*ColumnRule `toml:"columns"`
+
+	generated bool
+	progress  *stepProgress
 }
 
+var stepConfigTemplate = template.Must(template.New("step").Parse(`[[steps]]
+table_name = '{{.TableName}}'
+{{if .SelectSQL -}}
+select_sql = '''
+{{.SelectSQL}}
+'''
+{{end}}`))
+
 func initConfigFile(ctx context.Context, configFilePath, sourceURL, destinationURL string, omitSelectSQL bool) error {
 	sourceConn, err := pgx.Connect(ctx, sourceURL)
 	if err != nil {
@@ -54,6 +94,96 @@ func initConfigFile(ctx context.Context, configFilePath, sourceURL, destinationU
 	}
 	defer sourceConn.Close(ctx)
 
+	steps, err := generateSteps(ctx, sourceConn, omitSelectSQL)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(configFilePath)
+	if err != nil {
+		return fmt.Errorf("error creating config file: %w", err)
+	}
+	defer file.Close()
+
+	tmpl := template.Must(template.Must(stepConfigTemplate.Clone()).New("config").Parse(`# parallelism is the number of steps that are executed concurrently. Each worker uses its own source and destination
+# connection. All source connections share the same snapshot so the copy is still consistent. Steps may run in any order
+# when parallelism is greater than 1.
+# parallelism = 1
+
+# checkpoint_file is where the progress of a run is recorded. If a run fails, it can be resumed with the -resume option.
+# checkpoint_file = "pg_partialcopy_checkpoint.json"
+
+# check_drift stops a run before the destination is prepared if the source has tables or columns that the steps do not
+# account for. The same check can be run with the -drift option.
+# check_drift = false
+
+# format is the format of the copy commands. It is "text" or "binary". binary is faster, especially for bytea, numeric,
+# and timestamp columns, but select_sql must return exactly the types of the destination columns. It can also be set for
+# each step.
+# format = "text"
+
+# source is the database from which data will be copied.
+[source]
+# database_url is a URL or key-value connection string. It is required.
+database_url = {{.QuotedSourceURL}}
+
+# before_transaction_sql is SQL that is run before the read-only transaction is started. A common use case would be to
+# create a temporary table and populate it with data that will be used in steps with select_sql. It requires a
+# parallelism of 1.
+# before_transaction_sql = ""
+
+# destination is the database to which data will be copied.
+[destination]
+# database_url is a URL or key-value connection string. It is required.
+database_url = {{.QuotedDestinationURL}}
+
+# prepare_command is command(s) that will be run to prepare the destination database. It is run with the "sh" shell.
+# Generally, it will optionally drop and create the empty destination database.
+# prepare_command = "dropdb --if-exists destination && createdb destination"
+
+# masking.columns is an array of rules that replace the values of a column as it is copied. If table_name is omitted the
+# rule applies to the column in every table. Rules can also be set on a step with [[steps.columns]].
+# [[masking.columns]]
+# table_name = "users"
+# name = "email"
+# transformer = "fake_email"
+
+# steps is an array of steps to execute.
+{{range .Steps -}}
+{{template "step" .}}
+{{end -}}
+`))
+
+	sb := &strings.Builder{}
+	err = toml.NewEncoder(sb).Encode(sourceURL)
+	if err != nil {
+		return fmt.Errorf("error encoding source URL: %w", err)
+	}
+	quotedSourceURL := sb.String()
+	sb.Reset()
+	err = toml.NewEncoder(sb).Encode(destinationURL)
+	if err != nil {
+		return fmt.Errorf("error encoding destination URL: %w", err)
+	}
+	quotedDestinationURL := sb.String()
+
+	err = tmpl.Execute(file, struct {
+		QuotedSourceURL      string
+		QuotedDestinationURL string
+		Steps                []*Step
+	}{
+		QuotedSourceURL:      quotedSourceURL,
+		QuotedDestinationURL: quotedDestinationURL,
+		Steps:                steps,
+	})
+	if err != nil {
+		return fmt.Errorf("error writing config file: %w", err)
+	}
+
+	return nil
+}
+
+func generateSteps(ctx context.Context, sourceConn *pgx.Conn, omitSelectSQL bool) ([]*Step, error) {
 	selectSQLBuilder := &strings.Builder{}
 	var sql string
 	sql = `select
@@ -63,6 +193,7 @@ from information_schema.tables
   join information_schema.columns using(table_schema, table_name)
 where table_schema not in ('information_schema', 'pg_catalog')
   and table_type = 'BASE TABLE'
+  and is_generated = 'NEVER'
 group by table_schema, table_name
 order by table_schema, table_name;`
 	rows, _ := sourceConn.Query(ctx, sql)
@@ -108,84 +239,31 @@ order by table_schema, table_name;`
 		}, nil
 	})
 	if err != nil {
-		return fmt.Errorf("error executing SQL to get table names: %w", err)
+		return nil, fmt.Errorf("error executing SQL to get table names: %w", err)
 	}
 
-	file, err := os.Create(configFilePath)
-	if err != nil {
-		return fmt.Errorf("error creating config file: %w", err)
-	}
-	defer file.Close()
-
-	tmpl := template.Must(template.New("config").Parse(`# source is the database from which data will be copied.
-[source]
-# database_url is a URL or key-value connection string. It is required.
-database_url = {{.QuotedSourceURL}}
-
-# before_transaction_sql is SQL that is run before the read-only transaction is started. A common use case would be to
-# create a temporary table and populate it with data that will be used in steps with select_sql.
-# before_transaction_sql = ""
-
-# destination is the database to which data will be copied.
-[destination]
-# database_url is a URL or key-value connection string. It is required.
-database_url = {{.QuotedDestinationURL}}
-
-# prepare_command is command(s) that will be run to prepare the destination database. It is run with the "sh" shell.
-# Generally, it will optionally drop and create the empty destination database.
-# prepare_command = "dropdb --if-exists destination && createdb destination"
-
-# steps is an array of steps to execute.
-{{range .Steps -}}
-[[steps]]
-table_name = '{{.TableName}}'
-{{if .SelectSQL -}}
-select_sql = '''
-{{.SelectSQL}}
-'''
-{{end}}
-{{end -}}
-`))
-
-	sb := &strings.Builder{}
-	err = toml.NewEncoder(sb).Encode(sourceURL)
-	if err != nil {
-		return fmt.Errorf("error encoding source URL: %w", err)
-	}
-	quotedSourceURL := sb.String()
-	sb.Reset()
-	err = toml.NewEncoder(sb).Encode(destinationURL)
-	if err != nil {
-		return fmt.Errorf("error encoding destination URL: %w", err)
-	}
-	quotedDestinationURL := sb.String()
+	return steps, nil
+}
 
-	err = tmpl.Execute(file, struct {
-		QuotedSourceURL      string
-		QuotedDestinationURL string
-		Steps                []*Step
-	}{
-		QuotedSourceURL:      quotedSourceURL,
-		QuotedDestinationURL: quotedDestinationURL,
-		Steps:                steps,
-	})
+func renderConfigFile(configFilePath string) (string, error) {
+	file, err := os.ReadFile(configFilePath)
 	if err != nil {
-		return fmt.Errorf("error writing config file: %w", err)
+		return "", fmt.Errorf("error reading config file: %w", err)
 	}
 
-	return nil
+	return renderConfig(string(file))
 }
 
-func parseConfigFile(configFilePath string) (*Config, error) {
-	file, err := os.ReadFile(configFilePath)
+func parseConfig(s string) (*Config, error) {
+	s, err := renderConfig(s)
 	if err != nil {
-		return nil, fmt.Errorf("error reading config file: %w", err)
+		return nil, err
 	}
 
-	return parseConfig(string(file))
+	return decodeConfig(s)
 }
 
-func parseConfig(s string) (*Config, error) {
+func renderConfig(s string) (string, error) {
 	handler := sprout.New()
 	handler.AddRegistry(std.NewRegistry())
 	handler.AddRegistry(env.NewRegistry())
@@ -195,26 +273,104 @@ func parseConfig(s string) (*Config, error) {
 
 	tmpl, err := template.New("config").Funcs(handler.Build()).Parse(s)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing config template: %w", err)
+		return "", fmt.Errorf("error parsing config template: %w", err)
 	}
 
 	var buf bytes.Buffer
 	err = tmpl.Execute(&buf, nil)
 	if err != nil {
-		return nil, fmt.Errorf("error executing config template: %w", err)
+		return "", fmt.Errorf("error executing config template: %w", err)
 	}
-	s = buf.String()
 
+	return buf.String(), nil
+}
+
+func decodeConfig(s string) (*Config, error) {
 	var config Config
-	_, err = toml.Decode(s, &config)
+	md, err := toml.Decode(s, &config)
 	if err != nil {
 		return nil, fmt.Errorf("error decoding config file: %w", err)
 	}
 
+	for _, key := range md.Undecoded() {
+		config.undecodedKeys = append(config.undecodedKeys, key.String())
+	}
+
 	return &config, nil
 }
 
 func pgPartialCopy(ctx context.Context, config *Config) error {
+	config.report = newRunReport()
+	defer func() { config.report = nil }()
+
+	err := runCopy(ctx, config)
+
+	if config.ReportFile != "" {
+		config.report.finish(config.Steps, config.output != nil, err)
+		reportErr := config.report.write(config.ReportFile)
+		if reportErr != nil {
+			if err == nil {
+				return reportErr
+			}
+			slog.Warn("Unable to write report", "error", reportErr)
+		}
+	}
+
+	return err
+}
+
+func (config *Config) validateParallelism() error {
+	if config.Parallelism > 1 && config.Source.BeforeTransactionSQL != "" {
+		return fmt.Errorf("source.before_transaction_sql cannot be used with parallelism greater than 1")
+	}
+	return nil
+}
+
+func runCopy(ctx context.Context, config *Config) error {
+	err := config.validateDestination()
+	if err != nil {
+		return err
+	}
+	err = config.validateParallelism()
+	if err != nil {
+		return err
+	}
+	err = config.validateRefresh()
+	if err != nil {
+		return err
+	}
+	err = config.validateOnFKViolation()
+	if err != nil {
+		return err
+	}
+	err = config.validateVerify()
+	if err != nil {
+		return err
+	}
+	_, err = config.Masking.engine()
+	if err != nil {
+		return err
+	}
+
+	config.output, err = newFileOutput(config)
+	if err != nil {
+		return err
+	}
+	if config.output != nil {
+		defer config.output.cleanup()
+	}
+
+	var cp *checkpoint
+	if config.Resume {
+		if config.CheckpointFile == "" {
+			return fmt.Errorf("checkpoint_file is required to resume")
+		}
+		cp, err = readCheckpoint(config.CheckpointFile)
+		if err != nil {
+			return err
+		}
+	}
+
 	sourceConn, err := pgconn.Connect(ctx, config.Source.DatabaseURL)
 	if err != nil {
 		return fmt.Errorf("error connecting to source database: %w", err)
@@ -243,65 +399,453 @@ func pgPartialCopy(ctx context.Context, config *Config) error {
 		return fmt.Errorf("expected one row from pg_export_snapshot, got %d", len(result.Rows))
 	}
 	snapshotID = string(result.Rows[0][0])
+	config.report.SnapshotID = snapshotID
 	slog.Info("Began transaction on source", "snapshot_id", snapshotID)
 
-	structureSQL, err := pgDumpStructureFromSource(config.Source.DatabaseURL, snapshotID)
+	result = sourceConn.ExecParams(ctx, "select txid_current_snapshot()::text", nil, nil, nil, nil).Read()
+	if result.Err != nil {
+		return fmt.Errorf("error getting current snapshot: %w", result.Err)
+	}
+	sourceSnapshot := string(result.Rows[0][0])
+
+	config.Steps, err = expandSubsetSteps(ctx, sourceConn, config.Steps)
 	if err != nil {
-		return fmt.Errorf("error dumping structure from source: %w", err)
+		return fmt.Errorf("error expanding subset steps: %w", err)
+	}
+
+	if config.CheckDrift {
+		problems, err := detectDrift(ctx, config, sourceConn, config.Steps)
+		if err != nil {
+			return fmt.Errorf("error detecting drift: %w", err)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("source has drifted from config:\n%s", strings.Join(problems, "\n"))
+		}
+		slog.Info("Checked for drift")
 	}
-	slog.Info("Dumped structure from source")
 
-	err = prepareDestination(config.Destination)
+	err = config.filterSteps()
 	if err != nil {
-		return fmt.Errorf("error preparing destination: %w", err)
+		return err
+	}
+
+	var preDataSQL, postDataSQL []byte
+	var structureHash string
+	if !config.refresh() {
+		start := time.Now()
+		preDataSQL, err = pgDumpStructureFromSource(config.Source.DatabaseURL, snapshotID, "pre-data")
+		if err != nil {
+			return fmt.Errorf("error dumping structure from source: %w", err)
+		}
+		postDataSQL, err = pgDumpStructureFromSource(config.Source.DatabaseURL, snapshotID, "post-data")
+		if err != nil {
+			return fmt.Errorf("error dumping structure from source: %w", err)
+		}
+		config.report.recordPhase("pg_dump", start)
+		slog.Info("Dumped structure from source")
+		structureHash = hashStructureSQL(bytes.Join([][]byte{preDataSQL, postDataSQL}, nil))
 	}
-	slog.Info("Prepared destination")
 
-	err = loadStructureToDestination(config.Destination.DatabaseURL, structureSQL)
+	if cp != nil {
+		err = cp.checkSteps(config.Steps)
+		if err != nil {
+			return fmt.Errorf("error resuming: %w", err)
+		}
+		if cp.StructureHash != structureHash {
+			return fmt.Errorf("error resuming: structure of source has changed since checkpoint was written")
+		}
+		if cp.SourceSnapshot == sourceSnapshot {
+			slog.Info("Resuming from checkpoint. Source has not changed so the copy will be consistent.", "checkpoint_snapshot_id", cp.SnapshotID)
+		} else {
+			slog.Warn("Resuming from checkpoint. Source may have changed so the copy may not be consistent.",
+				"checkpoint_snapshot_id", cp.SnapshotID,
+				"checkpoint_source_snapshot", cp.SourceSnapshot,
+				"source_snapshot", sourceSnapshot,
+			)
+		}
+	} else if !config.refresh() && config.output == nil {
+		start := time.Now()
+		err = prepareDestination(config.Destination)
+		if err != nil {
+			return fmt.Errorf("error preparing destination: %w", err)
+		}
+		config.report.recordPhase("prepare_destination", start)
+		slog.Info("Prepared destination")
+
+		start = time.Now()
+		err = loadStructureToDestination(config.Destination.DatabaseURL, preDataSQL)
+		if err != nil {
+			return fmt.Errorf("error loading structure to destination: %w", err)
+		}
+		config.report.recordPhase("pre_data", start)
+		slog.Info("Loaded pre-data structure to destination")
+	}
+
+	var sequenceValues []*sequenceValue
+	var destinationConn *pgconn.PgConn
+	if config.output != nil {
+		sequenceValues, err = getSequenceValues(ctx, sourceConn)
+		if err != nil {
+			return fmt.Errorf("error getting sequence values: %w", err)
+		}
+	} else {
+		destinationConn, err = pgconn.Connect(ctx, config.Destination.DatabaseURL)
+		if err != nil {
+			return fmt.Errorf("error connecting to destination database: %w", err)
+		}
+		defer destinationConn.Close(ctx)
+
+		err = copySequenceValues(ctx, sourceConn, destinationConn, config.refresh())
+		if err != nil {
+			return fmt.Errorf("error copying sequence values: %w", err)
+		}
+		slog.Info("Copied sequence values")
+	}
+
+	// The foreign key constraints are dropped so the tables can be truncated and loaded in any order.
+	var recreateForeignKeys []*foreignKey
+	if config.refresh() {
+		if cp != nil {
+			recreateForeignKeys = cp.RecreateForeignKeys
+		} else {
+			recreateForeignKeys, err = dropForeignKeyConstraints(ctx, destinationConn, config.Steps)
+			if err != nil {
+				return fmt.Errorf("error dropping foreign key constraints: %w", err)
+			}
+			slog.Info("Dropped foreign key constraints", "count", len(recreateForeignKeys))
+		}
+	}
+
+	if cp == nil && config.CheckpointFile != "" && config.output == nil {
+		cp = newCheckpoint(config.CheckpointFile, config.Steps)
+		cp.SnapshotID = snapshotID
+		cp.SourceSnapshot = sourceSnapshot
+		cp.StructureHash = structureHash
+		cp.RecreateForeignKeys = recreateForeignKeys
+		err = cp.save()
+		if err != nil {
+			return err
+		}
+	}
+
+	progress, err := newProgressReporter(ctx, sourceConn, config.Steps)
 	if err != nil {
-		return fmt.Errorf("error loading structure to destination: %w", err)
+		return err
 	}
-	slog.Info("Loaded structure to destination")
 
-	destinationConn, err := pgconn.Connect(ctx, config.Destination.DatabaseURL)
+	workers, err := startCopyWorkers(ctx, config, sourceConn, destinationConn, snapshotID)
+	defer closeCopyWorkers(ctx, workers)
 	if err != nil {
-		return fmt.Errorf("error connecting to destination database: %w", err)
+		return fmt.Errorf("error starting workers: %w", err)
 	}
-	defer destinationConn.Close(ctx)
 
-	err = copySequenceValues(ctx, sourceConn, destinationConn)
+	progress.start()
+	start := time.Now()
+	err = executeSteps(ctx, config, workers, snapshotID, cp)
+	progress.stop()
 	if err != nil {
-		return fmt.Errorf("error copying sequence values: %w", err)
+		return err
+	}
+	config.report.recordPhase("steps", start)
+
+	if config.output == nil && config.OnFKViolation != "" {
+		start := time.Now()
+		foreignKeys := recreateForeignKeys
+		if !config.refresh() {
+			foreignKeys, err = getForeignKeys(ctx, sourceConn)
+			if err != nil {
+				return fmt.Errorf("error getting foreign keys: %w", err)
+			}
+		}
+		err = handleForeignKeyViolations(ctx, destinationConn, config, foreignKeys)
+		if err != nil {
+			return err
+		}
+		config.report.recordPhase("foreign_key_violations", start)
 	}
-	slog.Info("Copied sequence values")
 
-	recreateForeignKeyConstraintCommands, err := dropForeignKeyConstraints(ctx, destinationConn)
+	start = time.Now()
+	if config.output != nil {
+		err = config.output.finish(&sourceStructure{
+			SnapshotID:     snapshotID,
+			PreDataSQL:     preDataSQL,
+			PostDataSQL:    postDataSQL,
+			SequenceValues: sequenceValues,
+		})
+		if err != nil {
+			return err
+		}
+		config.report.recordPhase("write_output", start)
+	} else if config.refresh() {
+		err = recreateForeignKeyConstraints(ctx, destinationConn, recreateForeignKeys, config.createForeignKeysNotValid())
+		if err != nil {
+			return fmt.Errorf("error recreating foreign key constraints: %w", err)
+		}
+		config.report.recordPhase("foreign_keys", start)
+		slog.Info("Recreated foreign key constraints")
+	} else {
+		err = loadPostData(ctx, config, postDataSQL)
+		if err != nil {
+			return fmt.Errorf("error loading post-data structure to destination: %w", err)
+		}
+		config.report.recordPhase("post_data", start)
+		slog.Info("Loaded post-data structure to destination")
+	}
+
+	if cp != nil {
+		err = cp.remove()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type copyWorker struct {
+	sourceConn      *pgconn.PgConn
+	destinationConn *pgconn.PgConn
+	owned           bool
+}
+
+func startCopyWorkers(ctx context.Context, config *Config, sourceConn, destinationConn *pgconn.PgConn, snapshotID string) ([]*copyWorker, error) {
+	parallelism := max(config.Parallelism, 1)
+	workers := make([]*copyWorker, 0, parallelism)
+	workers = append(workers, &copyWorker{sourceConn: sourceConn, destinationConn: destinationConn})
+
+	for len(workers) < parallelism {
+		workerSourceConn, err := connectSourceWithSnapshot(ctx, config.Source.DatabaseURL, snapshotID)
+		if err != nil {
+			return workers, err
+		}
+
+		var workerDestinationConn *pgconn.PgConn
+		if config.output == nil {
+			workerDestinationConn, err = pgconn.Connect(ctx, config.Destination.DatabaseURL)
+			if err != nil {
+				workerSourceConn.Close(ctx)
+				return workers, fmt.Errorf("error connecting to destination database: %w", err)
+			}
+		}
+
+		workers = append(workers, &copyWorker{sourceConn: workerSourceConn, destinationConn: workerDestinationConn, owned: true})
+	}
+
+	if parallelism > 1 {
+		slog.Info("Started workers", "parallelism", parallelism)
+	}
+
+	return workers, nil
+}
+
+func closeCopyWorkers(ctx context.Context, workers []*copyWorker) {
+	for _, w := range workers {
+		if w.owned {
+			w.sourceConn.Close(ctx)
+			if w.destinationConn != nil {
+				w.destinationConn.Close(ctx)
+			}
+		}
+	}
+}
+
+func connectSourceWithSnapshot(ctx context.Context, databaseURL, snapshotID string) (*pgconn.PgConn, error) {
+	conn, err := pgconn.Connect(ctx, databaseURL)
 	if err != nil {
-		return fmt.Errorf("error dropping foreign key constraints: %w", err)
+		return nil, fmt.Errorf("error connecting to source database: %w", err)
+	}
+
+	sql := fmt.Sprintf("begin isolation level repeatable read read only; set transaction snapshot '%s'", snapshotID)
+	err = conn.Exec(ctx, sql).Close()
+	if err != nil {
+		conn.Close(ctx)
+		return nil, fmt.Errorf("error importing snapshot %s: %w", snapshotID, err)
+	}
+
+	return conn, nil
+}
+
+type stepTask struct {
+	stepIdx int
+
+	// chunkIdx is -1 if the step is not chunked.
+	chunkIdx int
+}
+
+func executeSteps(ctx context.Context, config *Config, workers []*copyWorker, snapshotID string, cp *checkpoint) error {
+	steps := config.Steps
+
+	// Chunks are planned before the workers start because planning uses the connections of the first worker.
+	chunkedSteps := make(map[int]*chunkedStep)
+	for i, step := range steps {
+		if step.ChunkBy == "" {
+			continue
+		}
+		truncate := config.refresh() && !step.upsert(config)
+		if cp != nil {
+			switch cp.stepStatus(i) {
+			case checkpointStepCompleted:
+				step.progress.skip()
+				continue
+			case checkpointStepStarted:
+				truncate = !step.upsert(config)
+			}
+		}
+		if truncate {
+			err := truncateTable(ctx, workers[0].destinationConn, step.TableName)
+			if err != nil {
+				return fmt.Errorf("error truncating table of step %d (%s): %w", i, step.TableName, err)
+			}
+		}
+
+		chunks, err := planChunks(ctx, workers[0].sourceConn, step)
+		if err != nil {
+			return fmt.Errorf("error planning chunks of step %d (%s): %w", i, step.TableName, err)
+		}
+		chunkedSteps[i] = newChunkedStep(chunks)
+		slog.Info("Planned chunks", "idx", i, "table_name", step.TableName, "chunks", len(chunks))
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+
+	taskChan := make(chan stepTask)
+	g.Go(func() error {
+		defer close(taskChan)
+		for i := range steps {
+			tasks := []stepTask{{stepIdx: i, chunkIdx: -1}}
+			if cs := chunkedSteps[i]; cs != nil {
+				tasks = tasks[:0]
+				for j := range cs.chunks {
+					tasks = append(tasks, stepTask{stepIdx: i, chunkIdx: j})
+				}
+			}
+
+			for _, task := range tasks {
+				select {
+				case taskChan <- task:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+		return nil
+	})
+
+	for _, w := range workers {
+		g.Go(func() error {
+			for task := range taskChan {
+				i := task.stepIdx
+				step := steps[i]
+
+				if task.chunkIdx >= 0 {
+					err := executeChunk(ctx, config, snapshotID, w, cp, i, chunkedSteps[i], task.chunkIdx)
+					if err != nil {
+						return err
+					}
+					continue
+				}
+
+				if cp != nil {
+					switch cp.stepStatus(i) {
+					case checkpointStepCompleted:
+						step.progress.skip()
+						slog.Info("Skipped completed step", "idx", i, "table_name", step.TableName)
+						continue
+					case checkpointStepStarted:
+						// Upserting the rows again is harmless so rows upserted before the failure are kept.
+						if !step.upsert(config) {
+							err := truncateTable(ctx, w.destinationConn, step.TableName)
+							if err != nil {
+								return fmt.Errorf("error truncating table of step %d (%s): %w", i, step.TableName, err)
+							}
+						}
+					}
+					err := cp.setStepStatus(i, checkpointStepStarted)
+					if err != nil {
+						return err
+					}
+				}
+
+				step.progress.start()
+				var err error
+				if config.output != nil {
+					err = writeStep(ctx, config, w.sourceConn, task, step)
+				} else {
+					err = executeStep(ctx, config, w.sourceConn, w.destinationConn, step)
+				}
+				if err != nil {
+					return fmt.Errorf("error executing step %d (%s): %w", i, step.TableName, err)
+				}
+				step.progress.finish()
+				slog.Info("Executed step", "idx", i, "table_name", step.TableName)
+
+				if cp != nil {
+					err := cp.setStepStatus(i, checkpointStepCompleted)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
 	}
-	slog.Info("Dropped foreign key constraints")
 
-	for i, step := range config.Steps {
-		err = executeStep(ctx, sourceConn, destinationConn, step)
+	return g.Wait()
+}
+
+func executeChunk(ctx context.Context, config *Config, snapshotID string, w *copyWorker, cp *checkpoint, stepIdx int, cs *chunkedStep, chunkIdx int) error {
+	step := config.Steps[stepIdx]
+	step.progress.start()
+
+	if cs.start() && cp != nil {
+		err := cp.setStepStatus(stepIdx, checkpointStepStarted)
 		if err != nil {
-			return fmt.Errorf("error executing step %d (%s): %w", i, step.TableName, err)
+			return err
 		}
-		slog.Info("Executed step", "idx", i, "table_name", step.TableName)
 	}
 
-	err = recreateForeignKeyConstraints(ctx, destinationConn, recreateForeignKeyConstraintCommands)
+	err := copyChunkWithRetry(ctx, config, snapshotID, w, stepTask{stepIdx: stepIdx, chunkIdx: chunkIdx}, cs.chunks[chunkIdx])
 	if err != nil {
-		return fmt.Errorf("error recreating foreign key constraints: %w", err)
+		return fmt.Errorf("error executing chunk %d of step %d (%s): %w", chunkIdx, stepIdx, step.TableName, err)
+	}
+	slog.Info("Executed chunk", "idx", stepIdx, "table_name", step.TableName, "chunk", chunkIdx+1, "chunks", len(cs.chunks))
+
+	if cs.finish() {
+		step.progress.finish()
+		slog.Info("Executed step", "idx", stepIdx, "table_name", step.TableName)
+		if cp != nil {
+			err := cp.setStepStatus(stepIdx, checkpointStepCompleted)
+			if err != nil {
+				return err
+			}
+		}
 	}
-	slog.Info("Recreated foreign key constraints")
 
 	return nil
 }
 
-func pgDumpStructureFromSource(databaseURL, snapshotID string) ([]byte, error) {
+func truncateTable(ctx context.Context, conn *pgconn.PgConn, tableName string) error {
+	exists, err := tableExists(ctx, conn, tableName)
+	if err != nil || !exists {
+		return err
+	}
+
+	return conn.Exec(ctx, fmt.Sprintf("truncate %s", tableName)).Close()
+}
+
+func tableExists(ctx context.Context, conn *pgconn.PgConn, tableName string) (bool, error) {
+	result := conn.ExecParams(ctx, "select to_regclass($1) is not null", [][]byte{[]byte(tableName)}, nil, nil, nil).Read()
+	if result.Err != nil {
+		return false, result.Err
+	}
+	return string(result.Rows[0][0]) == "t", nil
+}
+
+func pgDumpStructureFromSource(databaseURL, snapshotID, section string) ([]byte, error) {
 	return exec.Command("pg_dump",
 		"--snapshot", snapshotID,
 		"--schema-only",
+		"--section", section,
 		"--no-owner",
 		"--no-privileges",
 		databaseURL,
@@ -322,65 +866,125 @@ func loadStructureToDestination(databaseURL string, structureSQL []byte) error {
 	return cmd.Run()
 }
 
-func dropForeignKeyConstraints(ctx context.Context, conn *pgconn.PgConn) ([]string, error) {
+type foreignKey struct {
+	Name                  string   `json:"name"`
+	TableName             string   `json:"table_name"`
+	ColumnNames           []string `json:"column_names"`
+	ReferencedTableName   string   `json:"referenced_table_name"`
+	ReferencedColumnNames []string `json:"referenced_column_names"`
+	Definition            string   `json:"definition"`
+	OnDelete              string   `json:"on_delete"`
+}
+
+func (fk *foreignKey) addConstraintSQL() string {
+	return fmt.Sprintf("alter table %s add constraint %s %s", fk.TableName, fk.Name, fk.Definition)
+}
+
+func getForeignKeys(ctx context.Context, conn *pgconn.PgConn) ([]*foreignKey, error) {
 	result := conn.ExecParams(
 		ctx,
-		"select conrelid::regclass as table_name, conname as constraint_name, pg_get_constraintdef(oid) constraint_definition from pg_constraint where contype = 'f'",
+		`select c.oid::text,
+  quote_ident(c.conname),
+  c.conrelid::regclass::text,
+  c.confrelid::regclass::text,
+  pg_get_constraintdef(c.oid),
+  case c.confdeltype when 'c' then 'cascade' when 'n' then 'set null' when 'd' then 'set default' when 'r' then 'restrict' else 'no action' end,
+  quote_ident(a.attname),
+  quote_ident(fa.attname)
+from pg_constraint c
+  cross join lateral unnest(c.conkey, c.confkey) with ordinality as k(attnum, fattnum, ord)
+  join pg_attribute a on a.attrelid = c.conrelid and a.attnum = k.attnum
+  join pg_attribute fa on fa.attrelid = c.confrelid and fa.attnum = k.fattnum
+where c.contype = 'f'
+order by c.oid, k.ord`,
 		nil, nil, nil, nil,
 	).Read()
 	if result.Err != nil {
 		return nil, result.Err
 	}
 
-	createForeignKeyConstraintCommands := make([]string, 0, len(result.Rows))
-
+	var foreignKeys []*foreignKey
+	var fk *foreignKey
+	var fkOID string
 	for _, row := range result.Rows {
-		tableName := string(row[0])
-		constraintName := string(row[1])
-		constraintDefinition := string(row[2])
-
-		dropConstraintSQL := fmt.Sprintf("alter table %s drop constraint %s", tableName, constraintName)
-		result = conn.ExecParams(ctx, dropConstraintSQL, nil, nil, nil, nil).Read()
-		if result.Err != nil {
-			return nil, result.Err
+		if fk == nil || fkOID != string(row[0]) {
+			fkOID = string(row[0])
+			fk = &foreignKey{
+				Name:                string(row[1]),
+				TableName:           string(row[2]),
+				ReferencedTableName: string(row[3]),
+				Definition:          string(row[4]),
+				OnDelete:            string(row[5]),
+			}
+			foreignKeys = append(foreignKeys, fk)
 		}
-
-		createForeignKeyConstraintCommands = append(createForeignKeyConstraintCommands, fmt.Sprintf("alter table %s add constraint %s %s", tableName, constraintName, constraintDefinition))
+		fk.ColumnNames = append(fk.ColumnNames, string(row[6]))
+		fk.ReferencedColumnNames = append(fk.ReferencedColumnNames, string(row[7]))
 	}
 
-	return createForeignKeyConstraintCommands, nil
+	return foreignKeys, nil
 }
 
-func recreateForeignKeyConstraints(ctx context.Context, conn *pgconn.PgConn, commands []string) error {
-	for _, cmd := range commands {
-		result := conn.ExecParams(ctx, cmd, nil, nil, nil, nil).Read()
-		if result.Err != nil {
-			return result.Err
+func executeStep(ctx context.Context, config *Config, sourceConn, destinationConn *pgconn.PgConn, step *Step) error {
+	plan, err := planStepCopy(ctx, config, sourceConn, step)
+	if err != nil {
+		return err
+	}
+
+	if config.refresh() && !step.upsert(config) {
+		err := truncateTable(ctx, destinationConn, step.TableName)
+		if err != nil {
+			return fmt.Errorf("error truncating table: %w", err)
 		}
 	}
-	return nil
-}
 
-func executeStep(ctx context.Context, sourceConn, destinationConn *pgconn.PgConn, step *Step) error {
+	var beforeCopySQLDuration, afterCopySQLDuration time.Duration
 	if step.BeforeCopySQL != "" {
+		start := time.Now()
 		err := destinationConn.Exec(ctx, step.BeforeCopySQL).Close()
 		if err != nil {
 			return fmt.Errorf("error executing before copy SQL: %w", err)
 		}
+		beforeCopySQLDuration = time.Since(start)
+	}
+
+	err = loadRows(ctx, config, sourceConn, destinationConn, step, plan)
+	if err != nil {
+		return err
 	}
 
+	if step.AfterCopySQL != "" {
+		start := time.Now()
+		err := executeAfterCopySQL(ctx, config, destinationConn, step)
+		if err != nil {
+			return fmt.Errorf("error executing after copy SQL: %w", err)
+		}
+		afterCopySQLDuration = time.Since(start)
+	}
+	step.progress.recordSQLDurations(beforeCopySQLDuration, afterCopySQLDuration)
+
+	return nil
+}
+
+func writeStep(ctx context.Context, config *Config, sourceConn *pgconn.PgConn, task stepTask, step *Step) error {
+	plan, err := planStepCopy(ctx, config, sourceConn, step)
+	if err != nil {
+		return err
+	}
+
+	return config.output.writeStep(ctx, sourceConn, task, step, plan)
+}
+
+func copyRows(ctx context.Context, sourceConn, destinationConn *pgconn.PgConn, plan *stepCopyPlan) error {
+	var sourceRows, copiedRows int64
+
 	r, w := io.Pipe()
 	g := &errgroup.Group{}
 	g.Go(func() error {
 		defer w.Close()
 
-		var copyToSQL string
-		if step.SelectSQL != "" {
-			copyToSQL = fmt.Sprintf("copy (%s) to stdout", step.SelectSQL)
-		} else {
-			copyToSQL = fmt.Sprintf("copy %s to stdout", step.TableName)
-		}
-		_, err := sourceConn.CopyTo(ctx, w, copyToSQL)
+		var err error
+		sourceRows, err = writeRows(ctx, sourceConn, w, plan)
 		if err != nil {
 			w.CloseWithError(err)
 			return err
@@ -390,42 +994,304 @@ func executeStep(ctx context.Context, sourceConn, destinationConn *pgconn.PgConn
 	})
 
 	g.Go(func() error {
-		copyFromSQL := fmt.Sprintf("copy %s from stdin", step.TableName)
-		_, err := destinationConn.CopyFrom(ctx, r, copyFromSQL)
+		commandTag, err := destinationConn.CopyFrom(ctx, r, plan.CopyFromSQL)
 		if err != nil {
 			r.CloseWithError(err)
 			return err
 		}
+		copiedRows = commandTag.RowsAffected()
+		plan.progress.countCopiedRows(commandTag)
 
 		return nil
 	})
 
-	if err := g.Wait(); err != nil {
+	err := g.Wait()
+	if err != nil {
 		return err
 	}
 
-	if step.AfterCopySQL != "" {
-		err := destinationConn.Exec(ctx, step.AfterCopySQL).Close()
+	if plan.verify != "" {
+		return verifyCopiedRows(ctx, sourceConn, plan, sourceRows, copiedRows)
+	}
+
+	return nil
+}
+
+func writeRows(ctx context.Context, sourceConn *pgconn.PgConn, w io.Writer, plan *stepCopyPlan) (int64, error) {
+	if plan.progress != nil {
+		pw := newProgressWriter(w, plan.progress, plan.Format)
+		uncountedPlan := *plan
+		uncountedPlan.progress = nil
+		n, err := writeRows(ctx, sourceConn, pw, &uncountedPlan)
 		if err != nil {
-			return fmt.Errorf("error executing after copy SQL: %w", err)
+			// The rows will be counted again if the copy is retried.
+			pw.discount()
+		}
+		return n, err
+	}
+
+	if plan.GoTransforms == nil {
+		commandTag, err := sourceConn.CopyTo(ctx, w, plan.CopyToSQL)
+		return commandTag.RowsAffected(), err
+	}
+
+	var sourceRows int64
+	r, pw := io.Pipe()
+	g := &errgroup.Group{}
+	g.Go(func() error {
+		defer pw.Close()
+
+		commandTag, err := sourceConn.CopyTo(ctx, pw, plan.CopyToSQL)
+		if err != nil {
+			pw.CloseWithError(err)
+			return err
+		}
+		sourceRows = commandTag.RowsAffected()
+
+		return nil
+	})
+
+	g.Go(func() error {
+		err := transformCopyText(w, r, plan.GoTransforms)
+		if err != nil {
+			r.CloseWithError(err)
+			return err
+		}
+
+		return nil
+	})
+
+	err := g.Wait()
+	return sourceRows, err
+}
+
+type stepCopyPlan struct {
+	SelectSQL              string
+	CopyToSQL              string
+	CopyFromSQL            string
+	CountSQL               string
+	ColumnNames            []string
+	DestinationColumnNames []string
+	GoTransforms           []goColumnTransform
+	Format                 string
+	Masked                 bool
+
+	progress *stepProgress
+	verify   string
+}
+
+func planStepCopy(ctx context.Context, config *Config, sourceConn *pgconn.PgConn, step *Step) (*stepCopyPlan, error) {
+	plan := &stepCopyPlan{progress: step.progress, verify: config.Verify}
+
+	// Generated columns cannot be copied to. In refresh mode the destination may have columns the source does not.
+	generatedColumnNames := make(map[string]bool)
+	if len(step.ColumnNames) > 0 {
+		plan.DestinationColumnNames = step.ColumnNames
+	} else {
+		tableName, err := resolveTableName(ctx, sourceConn, step.TableName)
+		if err != nil {
+			return nil, err
+		}
+		if tableName != "" {
+			columns, err := getTableColumns(ctx, sourceConn, tableName)
+			if err != nil {
+				return nil, err
+			}
+			var columnNames []string
+			for _, column := range columns {
+				if column.Generated {
+					generatedColumnNames[column.Name] = true
+				} else {
+					columnNames = append(columnNames, pgx.Identifier{column.Name}.Sanitize())
+				}
+			}
+			if len(generatedColumnNames) > 0 || config.refresh() {
+				plan.DestinationColumnNames = columnNames
+			}
+		}
+	}
+
+	columnList := ""
+	if plan.DestinationColumnNames != nil {
+		columnList = fmt.Sprintf(" (%s)", strings.Join(plan.DestinationColumnNames, ", "))
+	}
+	plan.CopyFromSQL = fmt.Sprintf("copy %s%s from stdin", step.TableName, columnList)
+
+	if step.SelectSQL != "" {
+		plan.SelectSQL = step.SelectSQL
+		if len(generatedColumnNames) > 0 {
+			// select_sql such as "select * from t" returns the generated columns.
+			selectColumnNames, err := describeColumnNames(ctx, sourceConn, step.SelectSQL)
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range selectColumnNames {
+				if generatedColumnNames[name] {
+					plan.SelectSQL = fmt.Sprintf("select %s from (%s) pg_partialcopy_select", strings.Join(plan.DestinationColumnNames, ", "), step.SelectSQL)
+					break
+				}
+			}
 		}
+		plan.CopyToSQL = fmt.Sprintf("copy (%s) to stdout", plan.SelectSQL)
+		plan.CountSQL = fmt.Sprintf("select count(*) from (%s) pg_partialcopy_count", plan.SelectSQL)
+	} else if plan.DestinationColumnNames != nil {
+		plan.SelectSQL = fmt.Sprintf("select %s from %s", strings.Join(plan.DestinationColumnNames, ", "), step.TableName)
+		plan.CopyToSQL = fmt.Sprintf("copy %s%s to stdout", step.TableName, columnList)
+		// Copying a table does not copy the rows of its inheritance children.
+		plan.CountSQL = fmt.Sprintf("select count(*) from only %s", step.TableName)
+	} else {
+		plan.SelectSQL = fmt.Sprintf("select * from %s", step.TableName)
+		plan.CopyToSQL = fmt.Sprintf("copy %s to stdout", step.TableName)
+		plan.CountSQL = fmt.Sprintf("select count(*) from only %s", step.TableName)
+	}
+
+	rules, err := columnRulesForStep(ctx, sourceConn, &config.Masking, step)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		err := plan.setFormat(config, step)
+		if err != nil {
+			return nil, err
+		}
+		return plan, nil
+	}
+	plan.Masked = true
+
+	engine, err := config.Masking.engine()
+	if err != nil {
+		return nil, err
+	}
+	switch engine {
+	case "sql":
+		selectSQL, err := maskedSelectSQL(ctx, sourceConn, &config.Masking, plan.SelectSQL, step, rules)
+		if err != nil {
+			return nil, err
+		}
+		if selectSQL != plan.SelectSQL {
+			plan.SelectSQL = selectSQL
+			plan.CopyToSQL = fmt.Sprintf("copy (%s) to stdout", selectSQL)
+			plan.CountSQL = fmt.Sprintf("select count(*) from (%s) pg_partialcopy_count", selectSQL)
+		}
+	case "go":
+		plan.ColumnNames, err = describeColumnNames(ctx, sourceConn, plan.SelectSQL)
+		if err != nil {
+			return nil, err
+		}
+		plan.GoTransforms, err = goColumnTransforms(&config.Masking, plan.ColumnNames, step, rules)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = plan.setFormat(config, step)
+	if err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+func (plan *stepCopyPlan) setFormat(config *Config, step *Step) error {
+	format := step.Format
+	if format == "" {
+		format = config.Format
+	}
+
+	switch format {
+	case "", "text":
+		plan.Format = "text"
+	case "binary":
+		// Masked values are text, which the binary format cannot load into columns of other types.
+		if plan.Masked {
+			plan.Format = "text"
+			return nil
+		}
+		plan.Format = "binary"
+		plan.CopyToSQL += " with (format binary)"
+		plan.CopyFromSQL += " with (format binary)"
+	default:
+		return fmt.Errorf("unknown format: %s", format)
 	}
 
 	return nil
 }
 
-func copySequenceValues(ctx context.Context, sourceConn, destinationConn *pgconn.PgConn) error {
-	result := sourceConn.ExecParams(
+type tableColumn struct {
+	Name      string
+	Generated bool
+}
+
+func getTableColumns(ctx context.Context, conn *pgconn.PgConn, tableName string) ([]*tableColumn, error) {
+	result := conn.ExecParams(ctx,
+		"select attname, attgenerated <> '' from pg_attribute where attrelid = $1::regclass and attnum > 0 and not attisdropped order by attnum",
+		[][]byte{[]byte(tableName)}, nil, nil, nil,
+	).Read()
+	if result.Err != nil {
+		return nil, fmt.Errorf("error getting columns of %s: %w", tableName, result.Err)
+	}
+
+	columns := make([]*tableColumn, len(result.Rows))
+	for i, row := range result.Rows {
+		columns[i] = &tableColumn{Name: string(row[0]), Generated: string(row[1]) == "t"}
+	}
+	return columns, nil
+}
+
+type sequenceValue struct {
+	Name      string `json:"name"`
+	LastValue *int64 `json:"last_value"`
+}
+
+func getSequenceValues(ctx context.Context, conn *pgconn.PgConn) ([]*sequenceValue, error) {
+	result := conn.ExecParams(
 		ctx,
 		`select format('%I.%I', schemaname, sequencename), last_value from pg_sequences`,
 		nil, nil, nil, nil,
 	).Read()
 	if result.Err != nil {
-		return result.Err
+		return nil, result.Err
 	}
 
-	for _, row := range result.Rows {
-		result = destinationConn.ExecParams(ctx, `select setval($1, $2)`, row, nil, nil, nil).Read()
+	values := make([]*sequenceValue, len(result.Rows))
+	for i, row := range result.Rows {
+		values[i] = &sequenceValue{Name: string(row[0])}
+		if row[1] != nil {
+			n, err := strconv.ParseInt(string(row[1]), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			values[i].LastValue = &n
+		}
+	}
+
+	return values, nil
+}
+
+func copySequenceValues(ctx context.Context, sourceConn, destinationConn *pgconn.PgConn, onlyAdvance bool) error {
+	values, err := getSequenceValues(ctx, sourceConn)
+	if err != nil {
+		return err
+	}
+
+	return setSequenceValues(ctx, destinationConn, values, onlyAdvance)
+}
+
+func setSequenceValues(ctx context.Context, conn *pgconn.PgConn, values []*sequenceValue, onlyAdvance bool) error {
+	setvalSQL := `select setval($1, $2)`
+	if onlyAdvance {
+		setvalSQL = `select setval(to_regclass($1), $2::bigint)
+from pg_sequences
+where format('%I.%I', schemaname, sequencename)::regclass = to_regclass($1)
+  and coalesce(last_value < $2::bigint, true)`
+	}
+
+	for _, value := range values {
+		if value.LastValue == nil {
+			continue
+		}
+		params := [][]byte{[]byte(value.Name), []byte(strconv.FormatInt(*value.LastValue, 10))}
+		result := conn.ExecParams(ctx, setvalSQL, params, nil, nil, nil).Read()
 		if result.Err != nil {
 			return result.Err
 		}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log/slog"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"testing"
 
 	"github.com/jackc/pgx/v5/pgconn"
@@ -35,6 +42,14 @@ create table c (
 );
 insert into c (name) values ('Moe'), ('Larry'), ('Curly');
 
+drop table if exists g;
+create table g (
+	id int primary key generated always as identity,
+	n int not null,
+	doubled int not null generated always as (n * 2) stored
+);
+insert into g (n) values (1), (2);
+
 drop schema if exists "special characters" cascade;
 create schema "special characters";
 create table "special characters"."Foo bar" (
@@ -333,6 +348,27 @@ select_sql = "select a.* from a join selected_a_ids s on a.id=s.id"
 	require.Equal(t, 2, len(result.Rows))
 	require.Equal(t, "1", string(result.Rows[0][0]))
 	require.Equal(t, "2", string(result.Rows[1][0]))
+
+	configText := `parallelism = 2
+
+[source]
+database_url = "dbname=pg_partialcopy_test_source"
+before_transaction_sql = "create temporary table selected_a_ids as select 1 as id"
+
+[destination]
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "a"
+select_sql = "select a.* from a join selected_a_ids s on a.id=s.id"`
+	err = parseAndRun(ctx, configText)
+	require.EqualError(t, err, "error running pg_partialcopy: source.before_transaction_sql cannot be used with parallelism greater than 1")
+
+	config, err := parseConfig(configText)
+	require.NoError(t, err)
+	problems, err := validateConfig(ctx, config)
+	require.NoError(t, err)
+	require.Contains(t, problems, "source.before_transaction_sql cannot be used with parallelism greater than 1")
 }
 
 func TestPGPartialCopySequence(t *testing.T) {
@@ -389,3 +425,1829 @@ table_name = '"special characters"."Foo bar"'`)
 	require.Equal(t, 1, len(result.Rows))
 	require.Equal(t, "3", string(result.Rows[0][0]))
 }
+
+func TestPGPartialCopyParallelism(t *testing.T) {
+	ctx := t.Context()
+	err := parseAndRun(ctx, `parallelism = 3
+
+[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "a"
+
+[[steps]]
+table_name = "b"
+
+[[steps]]
+table_name = "c"
+
+[[steps]]
+table_name = '"special characters"."Foo bar"'`)
+	require.NoError(t, err)
+
+	destinationConn := connectToDestination(t)
+	for _, tableName := range []string{"a", "b", "c"} {
+		result := destinationConn.ExecParams(ctx, fmt.Sprintf("select count(*) from %s", tableName), nil, nil, nil, nil).Read()
+		require.NoError(t, result.Err)
+		require.Equal(t, "3", string(result.Rows[0][0]), tableName)
+	}
+
+	result := destinationConn.ExecParams(ctx, `select count(*) from "special characters"."Foo bar"`, nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, "2", string(result.Rows[0][0]))
+}
+
+func TestPGPartialCopySubsetFollowsParents(t *testing.T) {
+	ctx := t.Context()
+	err := parseAndRun(ctx, `[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "b"
+where = "id = 2"`)
+	require.NoError(t, err)
+
+	destinationConn := connectToDestination(t)
+	result := destinationConn.ExecParams(ctx, "select * from b order by id", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, 1, len(result.Rows))
+	require.Equal(t, "2", string(result.Rows[0][0]))
+
+	// The row of a referenced by b must have been copied for the foreign key to be created.
+	result = destinationConn.ExecParams(ctx, "select * from a order by id", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, 1, len(result.Rows))
+	require.Equal(t, "2", string(result.Rows[0][0]))
+}
+
+func TestPGPartialCopySubsetIncludeChildren(t *testing.T) {
+	ctx := t.Context()
+	err := parseAndRun(ctx, `[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "a"
+where = "id in (1, 3)"
+include_children = true`)
+	require.NoError(t, err)
+
+	destinationConn := connectToDestination(t)
+	result := destinationConn.ExecParams(ctx, "select * from a order by id", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, 2, len(result.Rows))
+	require.Equal(t, "1", string(result.Rows[0][0]))
+	require.Equal(t, "3", string(result.Rows[1][0]))
+
+	result = destinationConn.ExecParams(ctx, "select * from b order by id", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, 2, len(result.Rows))
+	require.Equal(t, "1", string(result.Rows[0][0]))
+	require.Equal(t, "3", string(result.Rows[1][0]))
+}
+
+func TestPGPartialCopyMasking(t *testing.T) {
+	ctx := t.Context()
+	err := parseAndRun(ctx, `[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[masking.columns]]
+table_name = "c"
+name = "name"
+transformer = "truncate"
+length = 2
+
+[[masking.columns]]
+name = "name"
+transformer = "constant"
+value = "Redacted"
+
+[[steps]]
+table_name = "c"
+
+[[steps]]
+table_name = '"special characters"."Foo bar"'
+
+[[steps]]
+table_name = "a"
+
+[[steps.columns]]
+name = "id"
+transformer = "regex_replace"
+pattern = "^"
+replacement = "1"`)
+	require.NoError(t, err)
+
+	destinationConn := connectToDestination(t)
+	result := destinationConn.ExecParams(ctx, "select name from c order by id", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, 3, len(result.Rows))
+	require.Equal(t, "Mo", string(result.Rows[0][0]))
+	require.Equal(t, "La", string(result.Rows[1][0]))
+	require.Equal(t, "Cu", string(result.Rows[2][0]))
+
+	result = destinationConn.ExecParams(ctx, `select name from "special characters"."Foo bar" order by id`, nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, 2, len(result.Rows))
+	require.Equal(t, "Redacted", string(result.Rows[0][0]))
+	require.Equal(t, "Redacted", string(result.Rows[1][0]))
+
+	result = destinationConn.ExecParams(ctx, "select id from a order by id", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, 3, len(result.Rows))
+	require.Equal(t, "11", string(result.Rows[0][0]))
+	require.Equal(t, "12", string(result.Rows[1][0]))
+	require.Equal(t, "13", string(result.Rows[2][0]))
+}
+
+func TestPGPartialCopyMaskingShuffle(t *testing.T) {
+	ctx := t.Context()
+	err := parseAndRun(ctx, `[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "c"
+
+[[steps.columns]]
+name = "name"
+transformer = "shuffle"`)
+	require.NoError(t, err)
+
+	destinationConn := connectToDestination(t)
+	result := destinationConn.ExecParams(ctx, "select name from c order by name", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, 3, len(result.Rows))
+	require.Equal(t, "Curly", string(result.Rows[0][0]))
+	require.Equal(t, "Larry", string(result.Rows[1][0]))
+	require.Equal(t, "Moe", string(result.Rows[2][0]))
+}
+
+func TestPGPartialCopyMaskingKey(t *testing.T) {
+	ctx := t.Context()
+	err := parseAndRun(ctx, `[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[masking]
+key = "secret"
+
+[[masking.columns]]
+name = "name"
+transformer = "hash"
+
+[[steps]]
+table_name = "c"`)
+	require.NoError(t, err)
+
+	hmacHex := func(s string) string {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(s))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	destinationConn := connectToDestination(t)
+	result := destinationConn.ExecParams(ctx, "select name from c order by id", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, 3, len(result.Rows))
+	require.Equal(t, hmacHex("Moe"), string(result.Rows[0][0]))
+	require.Equal(t, hmacHex("Larry"), string(result.Rows[1][0]))
+	require.Equal(t, hmacHex("Curly"), string(result.Rows[2][0]))
+}
+
+func TestPGPartialCopyMaskingBinaryFormat(t *testing.T) {
+	ctx := t.Context()
+	err := parseAndRun(ctx, `format = "binary"
+
+[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "g"
+
+[[steps.columns]]
+name = "n"
+transformer = "constant"
+value = "7"`)
+	require.NoError(t, err)
+
+	destinationConn := connectToDestination(t)
+	result := destinationConn.ExecParams(ctx, "select n, doubled from g order by id", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Len(t, result.Rows, 2)
+	require.Equal(t, []string{"7", "14"}, []string{string(result.Rows[0][0]), string(result.Rows[0][1])})
+	require.Equal(t, []string{"7", "14"}, []string{string(result.Rows[1][0]), string(result.Rows[1][1])})
+}
+
+func TestPGPartialCopyMaskingKeySQLEngine(t *testing.T) {
+	ctx := t.Context()
+	err := parseAndRun(ctx, `[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[masking]
+engine = "sql"
+key = "secret"
+
+[[masking.columns]]
+name = "name"
+transformer = "hash"
+
+[[steps]]
+table_name = "c"`)
+	require.EqualError(t, err, "error running pg_partialcopy: masking.key cannot be used with masking.engine sql")
+}
+
+func TestPGPartialCopyMaskingGoEngine(t *testing.T) {
+	ctx := t.Context()
+	err := parseAndRun(ctx, `[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[masking]
+engine = "go"
+
+[[steps]]
+table_name = "c"
+
+[[steps.columns]]
+name = "name"
+transformer = "regex_replace"
+pattern = "(?i)^(.)(.*)$"
+replacement = "${2}${1}"
+
+[[steps]]
+table_name = '"special characters"."Foo bar"'
+
+[[steps.columns]]
+name = "name"
+transformer = "truncate"
+length = 1`)
+	require.NoError(t, err)
+
+	destinationConn := connectToDestination(t)
+	result := destinationConn.ExecParams(ctx, "select name from c order by id", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, 3, len(result.Rows))
+	require.Equal(t, "oeM", string(result.Rows[0][0]))
+	require.Equal(t, "arryL", string(result.Rows[1][0]))
+	require.Equal(t, "urlyC", string(result.Rows[2][0]))
+
+	result = destinationConn.ExecParams(ctx, `select name from "special characters"."Foo bar" order by id`, nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, 2, len(result.Rows))
+	require.Equal(t, "R", string(result.Rows[0][0]))
+	require.Equal(t, "L", string(result.Rows[1][0]))
+}
+
+func TestPGPartialCopyResume(t *testing.T) {
+	ctx := t.Context()
+	checkpointFile := filepath.Join(t.TempDir(), "checkpoint.json")
+	conf := `checkpoint_file = "` + checkpointFile + `"
+
+[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "a"
+
+[[steps]]
+table_name = "c"
+select_sql = "select id, {{env "PG_PARTIALCOPY_TEST_COLUMN"}} from c"`
+
+	t.Setenv("PG_PARTIALCOPY_TEST_COLUMN", "missing_column")
+	err := parseAndRun(ctx, conf)
+	require.ErrorContains(t, err, "missing_column")
+
+	cp, err := readCheckpoint(checkpointFile)
+	require.NoError(t, err)
+	require.Equal(t, checkpointStepCompleted, cp.Steps[0].Status)
+	require.Equal(t, checkpointStepStarted, cp.Steps[1].Status)
+
+	t.Setenv("PG_PARTIALCOPY_TEST_COLUMN", "name")
+	config, err := parseConfig(conf)
+	require.NoError(t, err)
+	config.Resume = true
+	err = pgPartialCopy(ctx, config)
+	require.NoError(t, err)
+
+	_, err = os.Stat(checkpointFile)
+	require.True(t, os.IsNotExist(err))
+
+	destinationConn := connectToDestination(t)
+	result := destinationConn.ExecParams(ctx, "select count(*) from a", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, "3", string(result.Rows[0][0]))
+
+	result = destinationConn.ExecParams(ctx, "select name from c order by id", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, 3, len(result.Rows))
+	require.Equal(t, "Moe", string(result.Rows[0][0]))
+}
+
+func TestPrintPlan(t *testing.T) {
+	ctx := t.Context()
+
+	// The destination does not exist and the prepare command would fail, so the plan must not touch either.
+	conf := `[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "false"
+database_url = "dbname=pg_partialcopy_test_does_not_exist"
+
+[[steps]]
+table_name = "b"
+where = "id = 2"
+
+[[steps]]
+table_name = "c"
+select_sql = "select id, name from c where id > 1"`
+	renderedConfig, err := renderConfig(conf)
+	require.NoError(t, err)
+	config, err := decodeConfig(renderedConfig)
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	err = printPlan(ctx, buf, config, renderedConfig)
+	require.NoError(t, err)
+
+	plan := buf.String()
+	require.Contains(t, plan, `database_url = "dbname=pg_partialcopy_test_does_not_exist"`)
+	require.Contains(t, plan, "Prepare command: false")
+	require.Contains(t, plan, "alter table b add constraint b_id_fkey FOREIGN KEY (id) REFERENCES a(id)")
+	require.Contains(t, plan, "## Step 0: b")
+	require.Contains(t, plan, "## Step 1: c")
+	require.Contains(t, plan, "copy (select id, name from c where id > 1) to stdout")
+	require.Contains(t, plan, "copy c from stdin")
+	require.Contains(t, plan, "## Step 2: a")
+	require.Contains(t, plan, "Estimated rows:")
+}
+
+func TestValidateConfig(t *testing.T) {
+	ctx := t.Context()
+	config, err := parseConfig(`[source]
+database_url = "dbname=pg_partialcopy_test_source"
+unknown_setting = "foo"
+
+[destination]
+
+[[steps]]
+table_name = "a"
+select_sql = "select id from a;"
+
+[[steps]]
+table_name = "a"
+
+[[steps]]
+table_name = "missing_table"
+
+[[steps]]
+table_name = "c"
+select_sql = "select id from c"
+
+[[steps]]
+table_name = '"special characters"."Foo bar"'
+select_sql = "select id, missing_column from c"
+
+[[steps]]
+table_name = "temp_a"
+select_sql = "select * from a"
+before_copy_sql = "create temporary table temp_a (like a)"`)
+	require.NoError(t, err)
+
+	problems, err := validateConfig(ctx, config)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"unknown key source.unknown_setting",
+		"destination.database_url is required",
+		"step 0 (a): select_sql must not end with a semicolon",
+		"step 1 (a): same table as step 0",
+		"step 2 (missing_table): table does not exist in source",
+		"step 3 (c): select_sql returns 1 columns but source table has 2",
+	}, problems[:6])
+	require.Len(t, problems, 7)
+	require.Contains(t, problems[6], `step 4 ("special characters"."Foo bar"): error describing select SQL`)
+	require.Contains(t, problems[6], "missing_column")
+}
+
+func TestValidateConfigDestination(t *testing.T) {
+	ctx := t.Context()
+
+	err := exec.Command("sh", "-c", "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination").Run()
+	require.NoError(t, err)
+	err = exec.Command("psql", "--no-psqlrc", "-c", `create table a (id int primary key, extra int);
+create table c (id int primary key, name text not null);`, destinationDatabaseURL).Run()
+	require.NoError(t, err)
+
+	config, err := parseConfig(`[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "a"
+
+[[steps]]
+table_name = "b"
+
+[[steps]]
+table_name = "c"
+select_sql = "select id, name as nickname from c"
+column_names = ["id", "nickname"]`)
+	require.NoError(t, err)
+
+	problems, err := validateConfig(ctx, config)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"step 0 (a): select_sql returns 1 columns but destination table has 2",
+		"step 2 (c): destination table has no column nickname",
+	}, problems)
+}
+
+func TestPGPartialCopyMaskingPatternEngines(t *testing.T) {
+	ctx := t.Context()
+
+	config := func(engine, pattern string) string {
+		return fmt.Sprintf(`[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[masking]
+engine = "%s"
+
+[[steps]]
+table_name = "c"
+
+[[steps.columns]]
+name = "name"
+transformer = "regex_replace"
+pattern = '%s'
+replacement = "*"`, engine, pattern)
+	}
+
+	for _, engine := range []string{"sql", "go"} {
+		t.Run(engine, func(t *testing.T) {
+			err := parseAndRun(ctx, config(engine, "[aeiou]"))
+			require.NoError(t, err)
+
+			destinationConn := connectToDestination(t)
+			result := destinationConn.ExecParams(ctx, "select string_agg(name, ',' order by id) from c", nil, nil, nil, nil).Read()
+			require.NoError(t, result.Err)
+			require.Equal(t, "M*e,L*rry,C*rly", string(result.Rows[0][0]))
+
+			for _, pattern := range []string{`\mL`, `(?P<first>L)`} {
+				c, err := parseConfig(config(engine, pattern))
+				require.NoError(t, err)
+				problems, err := validateConfig(ctx, c)
+				require.NoError(t, err)
+				if (engine == "sql") == (pattern == `\mL`) {
+					require.Empty(t, problems, pattern)
+				} else {
+					require.Len(t, problems, 1, pattern)
+					require.Contains(t, problems[0], "step 0 (c): column name: invalid pattern for masking.engine "+engine)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckDrift(t *testing.T) {
+	ctx := t.Context()
+	config, err := parseConfig(`[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "a"
+
+[[steps]]
+table_name = "c"
+select_sql = "select id from c where exists (select 1 from b)"
+
+[[steps]]
+table_name = "missing_table"`)
+	require.NoError(t, err)
+
+	problems, err := checkDrift(ctx, config)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"step 1 (c): column name is not mentioned in select_sql",
+		"step 2 (missing_table): table does not exist in source",
+		"table b is not copied by any step",
+		"table g is not copied by any step",
+		`table "special characters"."Foo bar" is not copied by any step`,
+	}, problems)
+
+	// A column or table mentioned in a comment is accounted for.
+	config.Steps[1].SelectSQL = "select id, /* name, b */ null as name from c"
+	config.Steps[2].TableName = `"special characters"."Foo bar"`
+	config.Steps = append(config.Steps, &Step{TableName: "g", ColumnNames: []string{"id", "n"}})
+	problems, err = checkDrift(ctx, config)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+}
+
+func TestPGPartialCopyCheckDrift(t *testing.T) {
+	ctx := t.Context()
+	err := parseAndRun(ctx, `check_drift = true
+
+[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "a"`)
+	require.ErrorContains(t, err, "table b is not copied by any step")
+}
+
+func TestUpdateConfigFile(t *testing.T) {
+	ctx := t.Context()
+	original := `# hand-edited comment
+[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "a"
+
+[[steps]]
+table_name = "c"
+select_sql = "select id from c"`
+
+	configFilePath := filepath.Join(t.TempDir(), "config.toml")
+	err := os.WriteFile(configFilePath, []byte(original), 0644)
+	require.NoError(t, err)
+
+	config, err := parseConfig(original)
+	require.NoError(t, err)
+	err = updateConfigFile(ctx, configFilePath, config, false, false)
+	require.NoError(t, err)
+
+	buf, err := os.ReadFile(configFilePath)
+	require.NoError(t, err)
+	require.Equal(t, original+`
+
+[[steps]]
+table_name = 'public.b'
+select_sql = '''
+select id
+from public.b
+'''
+
+[[steps]]
+table_name = 'public.g'
+select_sql = '''
+select id, n
+from public.g
+'''
+
+[[steps]]
+table_name = '"special characters"."Foo bar"'
+select_sql = '''
+select id, name
+from "special characters"."Foo bar"
+'''
+
+# select_sql of step 1 (c) does not mention name. The table now has these columns:
+# [[steps]]
+# table_name = 'public.c'
+# select_sql = '''
+# select id, name
+# from public.c
+# '''
+
+`, string(buf))
+
+	config, err = parseConfig(string(buf))
+	require.NoError(t, err)
+	require.Len(t, config.Steps, 5)
+	problems, err := checkDrift(ctx, config)
+	require.NoError(t, err)
+	require.Equal(t, []string{"step 1 (c): column name is not mentioned in select_sql"}, problems)
+
+	// The column is still not mentioned but its stanza is already in the file.
+	err = updateConfigFile(ctx, configFilePath, config, false, false)
+	require.NoError(t, err)
+	updated, err := os.ReadFile(configFilePath)
+	require.NoError(t, err)
+	require.Equal(t, string(buf), string(updated))
+}
+
+func TestUpdateConfigFileCommentOut(t *testing.T) {
+	ctx := t.Context()
+	original := `[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[[steps]]
+table_name = "a"
+
+[[steps]]
+table_name = "c"
+
+[[steps]]
+table_name = '"special characters"."Foo bar"'
+`
+
+	configFilePath := filepath.Join(t.TempDir(), "config.toml")
+	err := os.WriteFile(configFilePath, []byte(original), 0644)
+	require.NoError(t, err)
+
+	config, err := parseConfig(original)
+	require.NoError(t, err)
+	err = updateConfigFile(ctx, configFilePath, config, true, true)
+	require.NoError(t, err)
+
+	buf, err := os.ReadFile(configFilePath)
+	require.NoError(t, err)
+	require.Equal(t, original+`
+# [[steps]]
+# table_name = 'public.b'
+
+# [[steps]]
+# table_name = 'public.g'
+
+`, string(buf))
+
+	// The tables of commented-out steps are still not copied but their stanzas are already in the file.
+	config, err = parseConfig(string(buf))
+	require.NoError(t, err)
+	err = updateConfigFile(ctx, configFilePath, config, true, true)
+	require.NoError(t, err)
+	updated, err := os.ReadFile(configFilePath)
+	require.NoError(t, err)
+	require.Equal(t, string(buf), string(updated))
+}
+
+func TestPGPartialCopyGeneratedColumns(t *testing.T) {
+	ctx := t.Context()
+	err := parseAndRun(ctx, `[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "g"
+select_sql = "select * from g"`)
+	require.NoError(t, err)
+
+	destinationConn := connectToDestination(t)
+	result := destinationConn.ExecParams(ctx, "select id, n, doubled from g order by id", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Len(t, result.Rows, 2)
+	require.Equal(t, []string{"1", "1", "2"}, []string{string(result.Rows[0][0]), string(result.Rows[0][1]), string(result.Rows[0][2])})
+	require.Equal(t, []string{"2", "2", "4"}, []string{string(result.Rows[1][0]), string(result.Rows[1][1]), string(result.Rows[1][2])})
+
+	// The sequence of the identity column must have been copied.
+	result = destinationConn.ExecParams(ctx, "insert into g (n) values (3) returning id", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, "3", string(result.Rows[0][0]))
+}
+
+func TestPGPartialCopyColumnNames(t *testing.T) {
+	ctx := t.Context()
+	err := parseAndRun(ctx, `[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "g"
+column_names = ["n", "id"]
+select_sql = "select n * 10, id from g"`)
+	require.NoError(t, err)
+
+	destinationConn := connectToDestination(t)
+	result := destinationConn.ExecParams(ctx, "select id, n, doubled from g order by id", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Len(t, result.Rows, 2)
+	require.Equal(t, []string{"1", "10", "20"}, []string{string(result.Rows[0][0]), string(result.Rows[0][1]), string(result.Rows[0][2])})
+	require.Equal(t, []string{"2", "20", "40"}, []string{string(result.Rows[1][0]), string(result.Rows[1][1]), string(result.Rows[1][2])})
+}
+
+func BenchmarkExecuteStepFormat(b *testing.B) {
+	ctx := b.Context()
+	const rowCount = 100_000
+	const createTableSQL = `create table benchmark_rows (
+	id int primary key,
+	data bytea not null,
+	amount numeric not null,
+	created_at timestamptz not null
+)`
+
+	sourceConn, err := pgconn.Connect(ctx, sourceDatabaseURL)
+	require.NoError(b, err)
+	defer sourceConn.Close(ctx)
+
+	err = sourceConn.Exec(ctx, "drop table if exists benchmark_rows; "+createTableSQL+`;
+insert into benchmark_rows (id, data, amount, created_at)
+select n, sha256(n::text::bytea) || sha256(n::text::bytea), n * 1234.5678, '2000-01-01'::timestamptz + n * interval '1 minute'
+from generate_series(1, `+fmt.Sprint(rowCount)+`) n`).Close()
+	require.NoError(b, err)
+	b.Cleanup(func() {
+		err := sourceConn.Exec(context.Background(), "drop table benchmark_rows").Close()
+		require.NoError(b, err)
+	})
+
+	err = exec.Command("sh", "-c", "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination").Run()
+	require.NoError(b, err)
+	destinationConn, err := pgconn.Connect(ctx, destinationDatabaseURL)
+	require.NoError(b, err)
+	defer destinationConn.Close(ctx)
+	err = destinationConn.Exec(ctx, createTableSQL).Close()
+	require.NoError(b, err)
+
+	for _, format := range []string{"text", "binary"} {
+		b.Run(format, func(b *testing.B) {
+			config := &Config{Format: format}
+			step := &Step{TableName: "benchmark_rows"}
+			for range b.N {
+				b.StopTimer()
+				err := destinationConn.Exec(ctx, "truncate benchmark_rows").Close()
+				require.NoError(b, err)
+				b.StartTimer()
+
+				err = executeStep(ctx, config, sourceConn, destinationConn, step)
+				require.NoError(b, err)
+			}
+			b.ReportMetric(float64(rowCount*b.N)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
+
+func TestPGPartialCopyBinaryFormat(t *testing.T) {
+	ctx := t.Context()
+	config, err := parseConfig(`format = "binary"
+
+[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[masking]
+engine = "go"
+
+[[steps]]
+table_name = "a"
+
+[[steps]]
+table_name = "c"
+
+[[steps.columns]]
+name = "name"
+transformer = "constant"
+value = "Stooge"
+
+[[steps]]
+table_name = "g"
+format = "text"`)
+	require.NoError(t, err)
+
+	sourceConn, err := connectSourceForInspection(ctx, config)
+	require.NoError(t, err)
+	defer sourceConn.Close(ctx)
+	var formats []string
+	for _, step := range config.Steps {
+		plan, err := planStepCopy(ctx, config, sourceConn, step)
+		require.NoError(t, err)
+		formats = append(formats, plan.Format)
+	}
+	require.Equal(t, []string{"binary", "text", "text"}, formats)
+
+	err = pgPartialCopy(ctx, config)
+	require.NoError(t, err)
+
+	destinationConn := connectToDestination(t)
+	result := destinationConn.ExecParams(ctx, "select * from a order by id", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, 3, len(result.Rows))
+
+	result = destinationConn.ExecParams(ctx, "select distinct name from c", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, 1, len(result.Rows))
+	require.Equal(t, "Stooge", string(result.Rows[0][0]))
+
+	result = destinationConn.ExecParams(ctx, "select * from g order by id", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, 2, len(result.Rows))
+}
+
+func TestPlanChunks(t *testing.T) {
+	ctx := t.Context()
+	config, err := parseConfig(`[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[[steps]]
+table_name = "c"
+chunk_by = "primary_key"
+chunk_size = 2
+
+[[steps]]
+table_name = "c"
+select_sql = "select id, upper(name) from c"
+chunk_by = "primary_key"
+chunk_size = 10
+
+[[steps]]
+table_name = "a"
+chunk_by = "ctid"
+chunk_size = 1000`)
+	require.NoError(t, err)
+
+	sourceConn, err := connectSourceForInspection(ctx, config)
+	require.NoError(t, err)
+	defer sourceConn.Close(ctx)
+
+	var selectSQLs [][]string
+	for _, step := range config.Steps {
+		chunks, err := planChunks(ctx, sourceConn, step)
+		require.NoError(t, err)
+		var stepSelectSQLs []string
+		for _, chunk := range chunks {
+			require.Empty(t, chunk.ChunkBy)
+			stepSelectSQLs = append(stepSelectSQLs, chunk.SelectSQL)
+		}
+		selectSQLs = append(selectSQLs, stepSelectSQLs)
+	}
+	require.Equal(t, [][]string{
+		{"select * from c where id < 3", "select * from c where id >= 3"},
+		{"select * from (select id, upper(name) from c) pg_partialcopy_chunk where true"},
+		{"select * from a where true"},
+	}, selectSQLs)
+
+	_, err = planChunks(ctx, sourceConn, &Step{TableName: "c", SelectSQL: "select * from c", ChunkBy: "ctid", ChunkSize: 1})
+	require.ErrorContains(t, err, "chunk_by ctid cannot be used with select_sql")
+}
+
+func TestPlanChunksSparse(t *testing.T) {
+	ctx := t.Context()
+
+	sourceConn, err := pgconn.Connect(ctx, sourceDatabaseURL)
+	require.NoError(t, err)
+	defer sourceConn.Close(ctx)
+
+	err = sourceConn.Exec(ctx, `drop table if exists chunk_sparse_test;
+create table chunk_sparse_test (id bigint primary key);
+insert into chunk_sparse_test (id) values (-9000000000000000000), (1), (2), (9000000000000000000);`).Close()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := sourceConn.Exec(context.Background(), "drop table chunk_sparse_test").Close()
+		require.NoError(t, err)
+	})
+
+	chunks, err := planChunks(ctx, sourceConn, &Step{TableName: "chunk_sparse_test", ChunkBy: "primary_key", ChunkSize: 2})
+	require.NoError(t, err)
+	var selectSQLs []string
+	for _, chunk := range chunks {
+		selectSQLs = append(selectSQLs, chunk.SelectSQL)
+	}
+	require.Equal(t, []string{
+		"select * from chunk_sparse_test where id < 2",
+		"select * from chunk_sparse_test where id >= 2",
+	}, selectSQLs)
+}
+
+func TestPGPartialCopyChunked(t *testing.T) {
+	ctx := t.Context()
+	err := parseAndRun(ctx, `parallelism = 2
+
+[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "a"
+chunk_by = "ctid"
+chunk_size = 1
+
+[[steps]]
+table_name = "c"
+select_sql = "select id, upper(name) from c"
+chunk_by = "primary_key"
+chunk_size = 1
+chunk_retries = 2`)
+	require.NoError(t, err)
+
+	destinationConn := connectToDestination(t)
+	result := destinationConn.ExecParams(ctx, "select * from a order by id", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, 3, len(result.Rows))
+
+	result = destinationConn.ExecParams(ctx, "select name from c order by id", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, 3, len(result.Rows))
+	require.Equal(t, "MOE", string(result.Rows[0][0]))
+	require.Equal(t, "LARRY", string(result.Rows[1][0]))
+	require.Equal(t, "CURLY", string(result.Rows[2][0]))
+}
+
+func TestPGPartialCopyPostData(t *testing.T) {
+	ctx := t.Context()
+	err := parseAndRun(ctx, `parallelism = 2
+
+[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "a"
+
+[[steps]]
+table_name = "b"`)
+	require.NoError(t, err)
+
+	destinationConn := connectToDestination(t)
+	result := destinationConn.ExecParams(ctx,
+		"select conname from pg_constraint where conrelid in ('a'::regclass, 'b'::regclass) order by conname",
+		nil, nil, nil, nil,
+	).Read()
+	require.NoError(t, result.Err)
+	require.Len(t, result.Rows, 3)
+	require.Equal(t, "a_pkey", string(result.Rows[0][0]))
+	require.Equal(t, "b_id_fkey", string(result.Rows[1][0]))
+	require.Equal(t, "b_pkey", string(result.Rows[2][0]))
+}
+
+func TestPGPartialCopyPostDataViolation(t *testing.T) {
+	ctx := t.Context()
+	err := parseAndRun(ctx, `[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "a"
+select_sql = "select 1 from a"`)
+	require.ErrorContains(t, err, "error creating constraint a a_pkey")
+}
+
+func TestPGPartialCopyRefresh(t *testing.T) {
+	ctx := t.Context()
+	err := parseAndRun(ctx, `[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "a"
+
+[[steps]]
+table_name = "b"
+
+[[steps]]
+table_name = "c"
+
+[[steps]]
+table_name = "g"`)
+	require.NoError(t, err)
+
+	destinationConn := connectToDestination(t)
+	err = destinationConn.Exec(ctx, `alter table c add column nickname text;
+update c set name = 'Local' where id = 1;
+insert into c (id, name, nickname) values (100, 'Shemp', 'Local only');
+delete from b where id = 3;
+update g set n = 5 where id = 1;`).Close()
+	require.NoError(t, err)
+
+	err = parseAndRun(ctx, `[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+mode = "refresh"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "a"
+
+[[steps]]
+table_name = "b"
+refresh = "truncate"
+
+[[steps]]
+table_name = "c"
+refresh = "upsert"
+
+[[steps]]
+table_name = "g"
+refresh = "upsert"`)
+	require.NoError(t, err)
+
+	result := destinationConn.ExecParams(ctx, "select count(*) from b", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, "3", string(result.Rows[0][0]))
+
+	result = destinationConn.ExecParams(ctx, "select id, name, coalesce(nickname, '') from c order by id", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Len(t, result.Rows, 4)
+	require.Equal(t, []string{"1", "Moe", ""}, []string{string(result.Rows[0][0]), string(result.Rows[0][1]), string(result.Rows[0][2])})
+	require.Equal(t, []string{"100", "Shemp", "Local only"}, []string{string(result.Rows[3][0]), string(result.Rows[3][1]), string(result.Rows[3][2])})
+
+	result = destinationConn.ExecParams(ctx, "select n, doubled from g where id = 1", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, []string{"1", "2"}, []string{string(result.Rows[0][0]), string(result.Rows[0][1])})
+
+	result = destinationConn.ExecParams(ctx, "select convalidated from pg_constraint where conname = 'b_id_fkey'", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Len(t, result.Rows, 1)
+	require.Equal(t, "t", string(result.Rows[0][0]))
+
+	err = parseAndRun(ctx, `[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "c"
+refresh = "upsert"`)
+	require.EqualError(t, err, "error running pg_partialcopy: step 0 (c): refresh requires destination.mode to be refresh")
+}
+
+func TestPGPartialCopyRefreshUpsertColumnNames(t *testing.T) {
+	ctx := t.Context()
+	err := parseAndRun(ctx, `[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "g"`)
+	require.NoError(t, err)
+
+	destinationConn := connectToDestination(t)
+	err = destinationConn.Exec(ctx, "update g set n = 5 where id = 1").Close()
+	require.NoError(t, err)
+
+	// id is generated always, so the upsert fails if it assigns the primary key.
+	err = parseAndRun(ctx, `[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+mode = "refresh"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "g"
+select_sql = "select id, n from g"
+column_names = ["ID", "n"]
+refresh = "upsert"`)
+	require.NoError(t, err)
+
+	result := destinationConn.ExecParams(ctx, "select string_agg(id || ':' || n || ':' || doubled, ',' order by id) from g", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, "1:1:2,2:2:4", string(result.Rows[0][0]))
+}
+
+func TestPGPartialCopyArchive(t *testing.T) {
+	ctx := t.Context()
+	archivePath := filepath.Join(t.TempDir(), "copy.tar.gz")
+	err := parseAndRun(ctx, fmt.Sprintf(`[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+type = "archive"
+path = %q
+
+[[steps]]
+table_name = "a"
+chunk_by = "primary_key"
+chunk_size = 1
+
+[[steps]]
+table_name = "b"
+
+[[steps]]
+table_name = "c"
+select_sql = "select id, upper(name) from c"
+
+[[steps]]
+table_name = "g"`, archivePath))
+	require.NoError(t, err)
+
+	config := &Config{Destination: ConfigDestination{
+		PrepareCommand: "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination",
+		DatabaseURL:    destinationDatabaseURL,
+	}}
+	err = restoreArchive(ctx, archivePath, config)
+	require.NoError(t, err)
+
+	destinationConn := connectToDestination(t)
+	result := destinationConn.ExecParams(ctx, "select (select count(*) from a), (select count(*) from b), (select string_agg(name, ',' order by id) from c), (select sum(doubled) from g)", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, []string{"3", "3", "MOE,LARRY,CURLY", "6"}, []string{string(result.Rows[0][0]), string(result.Rows[0][1]), string(result.Rows[0][2]), string(result.Rows[0][3])})
+
+	result = destinationConn.ExecParams(ctx, "select nextval('c_id_seq')", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, "4", string(result.Rows[0][0]))
+
+	result = destinationConn.ExecParams(ctx, "select conname from pg_constraint where conname = 'b_id_fkey'", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Len(t, result.Rows, 1)
+}
+
+func TestPGPartialCopySQLScript(t *testing.T) {
+	ctx := t.Context()
+	scriptPath := filepath.Join(t.TempDir(), "copy.sql")
+	err := parseAndRun(ctx, fmt.Sprintf(`[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+type = "sql"
+path = %q
+
+[[steps]]
+table_name = "a"
+
+[[steps]]
+table_name = "b"
+after_copy_sql = "delete from b where id = 3"
+
+[[steps]]
+table_name = "c"
+select_sql = "select id, name || E'\\t''s' from c"
+
+[[steps]]
+table_name = "g"`, scriptPath))
+	require.NoError(t, err)
+
+	err = exec.Command("sh", "-c", "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination").Run()
+	require.NoError(t, err)
+	output, err := exec.Command("psql", "--no-psqlrc", "-v", "ON_ERROR_STOP=1", "-f", scriptPath, destinationDatabaseURL).CombinedOutput()
+	require.NoError(t, err, string(output))
+
+	destinationConn := connectToDestination(t)
+	result := destinationConn.ExecParams(ctx, "select (select count(*) from a), (select count(*) from b), (select name from c where id = 1), (select sum(doubled) from g)", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, []string{"3", "2", "Moe\t's", "6"}, []string{string(result.Rows[0][0]), string(result.Rows[0][1]), string(result.Rows[0][2]), string(result.Rows[0][3])})
+
+	result = destinationConn.ExecParams(ctx, "select nextval('c_id_seq')", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, "4", string(result.Rows[0][0]))
+
+	result = destinationConn.ExecParams(ctx, "select conname from pg_constraint where conname = 'b_id_fkey'", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Len(t, result.Rows, 1)
+}
+
+func TestPGPartialCopyFlatFiles(t *testing.T) {
+	ctx := t.Context()
+
+	for _, tt := range []struct {
+		format      string
+		expectedC   string
+		expectedFoo string
+	}{
+		{
+			format:      "csv",
+			expectedC:   "id,name\n1,Moe\n2,\"Larry, Jr.\"\n3,\n",
+			expectedFoo: "id,name\n1,Ricky\n2,Lucy\n",
+		},
+		{
+			format:      "jsonl",
+			expectedC:   `{"id":1,"name":"Moe"}` + "\n" + `{"id":2,"name":"Larry, Jr."}` + "\n" + `{"id":3,"name":null}` + "\n",
+			expectedFoo: `{"id":1,"name":"Ricky"}` + "\n" + `{"id":2,"name":"Lucy"}` + "\n",
+		},
+	} {
+		t.Run(tt.format, func(t *testing.T) {
+			dir := t.TempDir()
+			err := parseAndRun(ctx, fmt.Sprintf(`[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+type = %q
+path = %q
+
+[[steps]]
+table_name = "c"
+select_sql = "select id, case id when 2 then 'Larry, Jr.' when 3 then null else name end as name from c order by id"
+
+[[steps]]
+table_name = '"special characters"."Foo bar"'
+select_sql = 'select * from "special characters"."Foo bar" order by id'`, tt.format, dir))
+			require.NoError(t, err)
+
+			buf, err := os.ReadFile(filepath.Join(dir, "c."+tt.format))
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedC, string(buf))
+
+			buf, err = os.ReadFile(filepath.Join(dir, "special characters.Foo bar."+tt.format))
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedFoo, string(buf))
+
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			require.Len(t, entries, 2)
+		})
+	}
+}
+
+func TestPGPartialCopyFlatFilesMaskedJSONB(t *testing.T) {
+	ctx := t.Context()
+
+	dir := t.TempDir()
+	err := parseAndRun(ctx, fmt.Sprintf(`[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+type = "jsonl"
+path = %q
+
+[masking]
+engine = "go"
+
+[[steps]]
+table_name = "c"
+select_sql = "select id, jsonb_build_object('id', id) as data, jsonb_build_object('name', name) as kept from c order by id"
+
+[[steps.columns]]
+name = "data"
+transformer = "truncate"
+length = 3`, dir))
+	require.NoError(t, err)
+
+	buf, err := os.ReadFile(filepath.Join(dir, "c.jsonl"))
+	require.NoError(t, err)
+	require.Equal(t,
+		`{"id":1,"data":"{\"i","kept":{"name":"Moe"}}`+"\n"+
+			`{"id":2,"data":"{\"i","kept":{"name":"Larry"}}`+"\n"+
+			`{"id":3,"data":"{\"i","kept":{"name":"Curly"}}`+"\n",
+		string(buf),
+	)
+}
+
+func TestPGPartialCopyParquet(t *testing.T) {
+	ctx := t.Context()
+
+	dir := t.TempDir()
+	err := parseAndRun(ctx, fmt.Sprintf(`[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+type = "parquet"
+path = %q
+
+[[steps]]
+table_name = "c"
+select_sql = """select id, name, id * 1.25::numeric(10, 2) as amount, date '2020-01-01' + id as day,
+  timestamptz '2020-01-01 00:00:00+00' + id * interval '1 hour' as at, id %% 2 = 0 as even,
+  array[id, null, id * 2] as ids, jsonb_build_object('id', id) as data, date '0044-03-15 BC' as ancient,
+  timestamp '10000-01-01 00:00:00' + id * interval '1 day' as distant
+from c"""
+
+[[steps]]
+table_name = '"special characters"."Foo bar"'`, dir))
+	require.NoError(t, err)
+
+	for _, name := range []string{"c.parquet", "special characters.Foo bar.parquet"} {
+		buf, err := os.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		require.Equal(t, "PAR1", string(buf[:4]), name)
+		require.Equal(t, "PAR1", string(buf[len(buf)-4:]), name)
+	}
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+}
+
+func TestParquetOutputKeepsTransactionSettings(t *testing.T) {
+	ctx := t.Context()
+
+	sourceConn, err := pgconn.Connect(ctx, sourceDatabaseURL)
+	require.NoError(t, err)
+	defer sourceConn.Close(ctx)
+
+	err = sourceConn.Exec(ctx, "begin isolation level repeatable read; set local datestyle = 'SQL, DMY'; set local bytea_output = 'escape'").Close()
+	require.NoError(t, err)
+
+	output, err := newParquetOutput(t.TempDir())
+	require.NoError(t, err)
+	defer output.cleanup()
+
+	step := &Step{TableName: "c", SelectSQL: "select id, date '2020-01-01' + id as day from c"}
+	plan, err := planStepCopy(ctx, &Config{}, sourceConn, step)
+	require.NoError(t, err)
+	err = output.writeStep(ctx, sourceConn, stepTask{}, step, plan)
+	require.NoError(t, err)
+
+	failingStep := &Step{TableName: "c", SelectSQL: "select id / 0 as n from c"}
+	plan, err = planStepCopy(ctx, &Config{}, sourceConn, failingStep)
+	require.NoError(t, err)
+	err = output.writeStep(ctx, sourceConn, stepTask{stepIdx: 1}, failingStep, plan)
+	require.ErrorContains(t, err, "division by zero")
+	require.NoError(t, output.finish(nil))
+
+	// The settings needed to parse the text format must not apply to the rest of the transaction.
+	result := sourceConn.ExecParams(ctx, "select current_setting('datestyle'), current_setting('bytea_output')", nil, nil, nil, nil).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, "SQL, DMY", string(result.Rows[0][0]))
+	require.Equal(t, "escape", string(result.Rows[0][1]))
+}
+
+func TestPGPartialCopyReport(t *testing.T) {
+	ctx := t.Context()
+
+	readReport := func(t *testing.T, path string) *runReport {
+		buf, err := os.ReadFile(path)
+		require.NoError(t, err)
+		report := &runReport{}
+		err = json.Unmarshal(buf, report)
+		require.NoError(t, err)
+		return report
+	}
+
+	t.Run("Succeeded", func(t *testing.T) {
+		config, err := parseConfig(`[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "a"
+after_copy_sql = "delete from a where id = 3"
+
+[[steps]]
+table_name = "c"
+format = "binary"`)
+		require.NoError(t, err)
+		config.ReportFile = filepath.Join(t.TempDir(), "report.json")
+
+		err = pgPartialCopy(ctx, config)
+		require.NoError(t, err)
+
+		report := readReport(t, config.ReportFile)
+		require.Equal(t, reportStatusSucceeded, report.Status)
+		require.Empty(t, report.Error)
+		require.NotEmpty(t, report.SnapshotID)
+		for _, phase := range []string{"pg_dump", "prepare_destination", "pre_data", "steps", "post_data", "foreign_keys"} {
+			require.Contains(t, report.PhaseSeconds, phase)
+		}
+
+		require.Len(t, report.Steps, 2)
+		require.Equal(t, "a", report.Steps[0].TableName)
+		require.Equal(t, reportStepCompleted, report.Steps[0].Status)
+		// Rows is the number of rows copied, not the number left after after_copy_sql.
+		require.EqualValues(t, 3, report.Steps[0].Rows)
+		require.EqualValues(t, len("1\n2\n3\n"), report.Steps[0].Bytes)
+		require.Equal(t, reportStepCompleted, report.Steps[1].Status)
+		require.EqualValues(t, 3, report.Steps[1].Rows)
+		require.Positive(t, report.Steps[1].Bytes)
+	})
+
+	t.Run("Failed", func(t *testing.T) {
+		config, err := parseConfig(`[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "a"
+
+[[steps]]
+table_name = "c"
+select_sql = "select missing from c"
+
+[[steps]]
+table_name = "g"`)
+		require.NoError(t, err)
+		config.ReportFile = filepath.Join(t.TempDir(), "report.json")
+
+		err = pgPartialCopy(ctx, config)
+		require.Error(t, err)
+
+		report := readReport(t, config.ReportFile)
+		require.Equal(t, reportStatusFailed, report.Status)
+		require.Equal(t, err.Error(), report.Error)
+		require.Equal(t, []string{reportStepCompleted, reportStepFailed, reportStepNotStarted}, []string{
+			report.Steps[0].Status,
+			report.Steps[1].Status,
+			report.Steps[2].Status,
+		})
+	})
+}
+
+func TestPGPartialCopyOnFKViolation(t *testing.T) {
+	ctx := t.Context()
+
+	config := func(onFKViolation string) string {
+		return fmt.Sprintf(`on_fk_violation = %q
+
+[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "a"
+select_sql = "select * from a where id <> 2"
+
+[[steps]]
+table_name = "b"`, onFKViolation)
+	}
+
+	t.Run("error", func(t *testing.T) {
+		err := parseAndRun(ctx, config("error"))
+		require.EqualError(t, err, "error running pg_partialcopy: foreign key constraints are violated by the copied rows:\n"+
+			"b_id_fkey: 1 rows of b violate foreign key (id) references a (id). e.g. (2). Check the select_sql of step 1 (b) and step 0 (a).")
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		err := parseAndRun(ctx, config("delete"))
+		require.NoError(t, err)
+
+		destinationConn := connectToDestination(t)
+		result := destinationConn.ExecParams(ctx, "select (select count(*) from b), (select convalidated from pg_constraint where conname = 'b_id_fkey')", nil, nil, nil, nil).Read()
+		require.NoError(t, result.Err)
+		require.Equal(t, "2", string(result.Rows[0][0]))
+		require.Equal(t, "t", string(result.Rows[0][1]))
+	})
+
+	t.Run("not_valid", func(t *testing.T) {
+		err := parseAndRun(ctx, config("not_valid"))
+		require.NoError(t, err)
+
+		destinationConn := connectToDestination(t)
+		result := destinationConn.ExecParams(ctx, "select (select count(*) from b), (select convalidated from pg_constraint where conname = 'b_id_fkey')", nil, nil, nil, nil).Read()
+		require.NoError(t, result.Err)
+		require.Equal(t, "3", string(result.Rows[0][0]))
+		require.Equal(t, "f", string(result.Rows[0][1]))
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		err := parseAndRun(ctx, config("ignore"))
+		require.EqualError(t, err, "error running pg_partialcopy: unknown on_fk_violation: ignore")
+	})
+}
+
+func TestPGPartialCopyPruneFKViolations(t *testing.T) {
+	ctx := t.Context()
+
+	sourceConn, err := pgconn.Connect(ctx, sourceDatabaseURL)
+	require.NoError(t, err)
+	defer sourceConn.Close(ctx)
+
+	err = sourceConn.Exec(ctx, `drop schema if exists prune_test cascade;
+create schema prune_test;
+create table prune_test.customers (id int primary key);
+insert into prune_test.customers (id) values (1), (2), (3);
+create table prune_test.orders (id int primary key, customer_id int not null references prune_test.customers on delete cascade);
+insert into prune_test.orders (id, customer_id) values (10, 1), (20, 2), (30, 3);
+create table prune_test.line_items (id int primary key, order_id int not null references prune_test.orders on delete cascade);
+insert into prune_test.line_items (id, order_id) values (100, 10), (200, 20), (300, 30);
+create table prune_test.notes (id int primary key, order_id int references prune_test.orders on delete set null);
+insert into prune_test.notes (id, order_id) values (1000, 20), (2000, 30);
+create table prune_test.tags (id int primary key, order_id int default 10 references prune_test.orders on delete set default);
+insert into prune_test.tags (id, order_id) values (3000, 20), (4000, 30);`).Close()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := sourceConn.Exec(context.Background(), "drop schema prune_test cascade").Close()
+		require.NoError(t, err)
+	})
+
+	config := `on_fk_violation = "prune"
+
+[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "prune_test.customers"
+select_sql = "select * from prune_test.customers where id <> 2"
+
+[[steps]]
+table_name = "prune_test.orders"
+
+[[steps]]
+table_name = "prune_test.line_items"
+
+[[steps]]
+table_name = "prune_test.notes"
+
+[[steps]]
+table_name = "prune_test.tags"`
+	err = parseAndRun(ctx, config)
+	require.NoError(t, err)
+
+	destinationConn := connectToDestination(t)
+	result := destinationConn.ExecParams(ctx, `select
+  (select string_agg(id::text, ',' order by id) from prune_test.orders),
+  (select string_agg(id::text, ',' order by id) from prune_test.line_items),
+  (select string_agg(id || ':' || coalesce(order_id::text, 'null'), ',' order by id) from prune_test.notes),
+  (select string_agg(id || ':' || order_id, ',' order by id) from prune_test.tags),
+  (select bool_and(convalidated) from pg_constraint where contype = 'f' and connamespace = 'prune_test'::regnamespace)`,
+		nil, nil, nil, nil,
+	).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, []string{"10,30", "100,300", "1000:null,2000:30", "3000:10,4000:30", "t"}, []string{
+		string(result.Rows[0][0]),
+		string(result.Rows[0][1]),
+		string(result.Rows[0][2]),
+		string(result.Rows[0][3]),
+		string(result.Rows[0][4]),
+	})
+
+	err = sourceConn.Exec(ctx, `create table prune_test.invoices (id int primary key, order_id int not null constraint invoices_order_fk references prune_test.orders on delete restrict);
+insert into prune_test.invoices (id, order_id) values (5000, 10), (6000, 20);`).Close()
+	require.NoError(t, err)
+
+	err = parseAndRun(ctx, config+`
+
+[[steps]]
+table_name = "prune_test.invoices"`)
+	require.ErrorContains(t, err, "1 rows of prune_test.invoices violate foreign key constraint invoices_order_fk, which is on delete restrict")
+}
+
+func TestPGPartialCopyVerify(t *testing.T) {
+	ctx := t.Context()
+
+	config := func(verify string) string {
+		return fmt.Sprintf(`verify = "%s"
+
+[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "a"
+select_sql = "select * from a where id <> 2"
+after_copy_sql = "delete from a where id = 3"
+
+[[steps]]
+table_name = "c"
+format = "binary"`, verify)
+	}
+
+	for _, verify := range []string{"rows", "count"} {
+		t.Run(verify, func(t *testing.T) {
+			config, err := parseConfig(config(verify))
+			require.NoError(t, err)
+			config.ReportFile = filepath.Join(t.TempDir(), "report.json")
+
+			err = pgPartialCopy(ctx, config)
+			require.NoError(t, err)
+
+			buf, err := os.ReadFile(config.ReportFile)
+			require.NoError(t, err)
+			report := &runReport{}
+			err = json.Unmarshal(buf, report)
+			require.NoError(t, err)
+			require.EqualValues(t, 2, report.Steps[0].Rows)
+			require.EqualValues(t, 1, report.Steps[0].AfterCopySQLRemovedRows)
+			require.EqualValues(t, 3, report.Steps[1].Rows)
+			require.Zero(t, report.Steps[1].AfterCopySQLRemovedRows)
+		})
+	}
+
+	t.Run("after_copy_sql drops table", func(t *testing.T) {
+		err := parseAndRun(ctx, `verify = "count"
+
+[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "temp_a"
+select_sql = "select * from a"
+before_copy_sql = "create temporary table temp_a (like a)"
+after_copy_sql = """
+insert into a select * from temp_a;
+drop table temp_a;
+"""`)
+		require.NoError(t, err)
+
+		destinationConn := connectToDestination(t)
+		result := destinationConn.ExecParams(ctx, "select count(*) from a", nil, nil, nil, nil).Read()
+		require.NoError(t, result.Err)
+		require.Equal(t, "3", string(result.Rows[0][0]))
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		err := parseAndRun(ctx, config("always"))
+		require.EqualError(t, err, "error running pg_partialcopy: unknown verify: always")
+	})
+}
+
+func TestPGPartialCopyForeignKeyCycle(t *testing.T) {
+	ctx := t.Context()
+
+	sourceConn, err := pgconn.Connect(ctx, sourceDatabaseURL)
+	require.NoError(t, err)
+	defer sourceConn.Close(ctx)
+
+	// Creating reciprocal foreign key constraints concurrently can deadlock because each locks both tables.
+	err = sourceConn.Exec(ctx, `drop schema if exists fk_cycle_test cascade;
+create schema fk_cycle_test;
+create table fk_cycle_test.x (id int primary key, y_id int, other_y_id int);
+create table fk_cycle_test.y (id int primary key, x_id int, other_x_id int);
+insert into fk_cycle_test.x (id, y_id, other_y_id) select n, n, n from generate_series(1, 1000) n;
+insert into fk_cycle_test.y (id, x_id, other_x_id) select n, n, n from generate_series(1, 1000) n;
+alter table fk_cycle_test.x add foreign key (y_id) references fk_cycle_test.y;
+alter table fk_cycle_test.x add foreign key (other_y_id) references fk_cycle_test.y;
+alter table fk_cycle_test.y add foreign key (x_id) references fk_cycle_test.x;
+alter table fk_cycle_test.y add foreign key (other_x_id) references fk_cycle_test.x;`).Close()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := sourceConn.Exec(context.Background(), "drop schema fk_cycle_test cascade").Close()
+		require.NoError(t, err)
+	})
+
+	err = parseAndRun(ctx, `parallelism = 4
+
+[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "fk_cycle_test.x"
+
+[[steps]]
+table_name = "fk_cycle_test.y"`)
+	require.NoError(t, err)
+
+	destinationConn := connectToDestination(t)
+	result := destinationConn.ExecParams(ctx,
+		"select count(*) from pg_constraint where contype = 'f' and convalidated and connamespace = 'fk_cycle_test'::regnamespace",
+		nil, nil, nil, nil,
+	).Read()
+	require.NoError(t, result.Err)
+	require.Equal(t, "4", string(result.Rows[0][0]))
+}
+
+func TestPGPartialCopyCommandLineFilters(t *testing.T) {
+	ctx := t.Context()
+
+	// run copies with conf as main does with the command line options in flags.
+	run := func(t *testing.T, conf string, flags map[string]string) error {
+		config, err := parseConfig(conf)
+		require.NoError(t, err)
+
+		for name, value := range flags {
+			require.NoError(t, flag.CommandLine.Set(name, value))
+		}
+		defer func() {
+			for name := range flags {
+				require.NoError(t, flag.CommandLine.Set(name, flag.Lookup(name).DefValue))
+			}
+		}()
+		applyFlags(config)
+
+		return pgPartialCopy(ctx, config)
+	}
+
+	countRows := func(t *testing.T, tableName string) string {
+		destinationConn := connectToDestination(t)
+		result := destinationConn.ExecParams(ctx, "select count(*) from "+tableName, nil, nil, nil, nil).Read()
+		require.NoError(t, result.Err)
+		return string(result.Rows[0][0])
+	}
+
+	t.Run("skip generated subset step", func(t *testing.T) {
+		err := run(t, `[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "a"
+where = "id in (1, 3)"
+include_children = true`, map[string]string{"skip": "b"})
+		require.NoError(t, err)
+		require.Equal(t, "2", countRows(t, "a"))
+		require.Equal(t, "0", countRows(t, "b"))
+	})
+
+	allTablesConfig := `check_drift = true
+
+[source]
+database_url = "dbname=pg_partialcopy_test_source"
+
+[destination]
+prepare_command = "dropdb --if-exists pg_partialcopy_test_destination && createdb pg_partialcopy_test_destination"
+database_url = "dbname=pg_partialcopy_test_destination"
+
+[[steps]]
+table_name = "a"
+
+[[steps]]
+table_name = "b"
+
+[[steps]]
+table_name = "c"
+
+[[steps]]
+table_name = "g"
+
+[[steps]]
+table_name = '"special characters"."Foo bar"'`
+
+	t.Run("only with check_drift", func(t *testing.T) {
+		// The tables of the steps that are not selected are not drift.
+		err := run(t, allTablesConfig, map[string]string{"only": "c,g"})
+		require.NoError(t, err)
+		require.Equal(t, "0", countRows(t, "a"))
+		require.Equal(t, "3", countRows(t, "c"))
+		require.Equal(t, "2", countRows(t, "g"))
+	})
+
+	t.Run("skipstructure", func(t *testing.T) {
+		destinationConn := connectToDestination(t)
+		err := destinationConn.Exec(ctx, "create table local_only (id int); insert into local_only values (1); delete from c").Close()
+		require.NoError(t, err)
+
+		err = run(t, allTablesConfig, map[string]string{"only": "c", "skipstructure": "true"})
+		require.NoError(t, err)
+		require.Equal(t, "1", countRows(t, "local_only"))
+		require.Equal(t, "3", countRows(t, "c"))
+		require.Equal(t, "2", countRows(t, "g"))
+	})
+
+	t.Run("only pattern matches nothing", func(t *testing.T) {
+		err := run(t, allTablesConfig, map[string]string{"only": "missing_*"})
+		require.EqualError(t, err, "only pattern missing_* does not match any step")
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func printPlan(ctx context.Context, w io.Writer, config *Config, renderedConfig string) error {
+	fmt.Fprintf(w, "# Rendered config\n\n%s\n", strings.TrimSpace(renderedConfig))
+
+	sourceConn, err := connectSourceForInspection(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer sourceConn.Close(ctx)
+
+	config.Steps, err = expandSubsetSteps(ctx, sourceConn, config.Steps)
+	if err != nil {
+		return fmt.Errorf("error expanding subset steps: %w", err)
+	}
+	err = config.filterSteps()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\n# Destination\n\n")
+	if config.Destination.Type != "" && config.Destination.Type != "database" {
+		fmt.Fprintf(w, "Type: %s\nPath: %s\n", config.Destination.Type, config.Destination.Path)
+	} else if config.refresh() {
+		fmt.Fprintf(w, "Mode: refresh. The structure of the destination is kept.\n")
+	} else if config.Destination.PrepareCommand != "" {
+		fmt.Fprintf(w, "Prepare command: %s\n", config.Destination.PrepareCommand)
+	} else {
+		fmt.Fprintf(w, "Prepare command: none\n")
+	}
+
+	foreignKeys, err := getForeignKeys(ctx, sourceConn)
+	if err != nil {
+		return fmt.Errorf("error getting foreign keys: %w", err)
+	}
+	fmt.Fprintf(w, "\n# Foreign key constraints created after the steps\n\n")
+	for _, fk := range foreignKeys {
+		fmt.Fprintf(w, "%s\n", fk.addConstraintSQL())
+	}
+	if len(foreignKeys) == 0 {
+		fmt.Fprintf(w, "none\n")
+	}
+
+	fmt.Fprintf(w, "\n# Steps\n")
+	for i, step := range config.Steps {
+		plan, err := planStepCopy(ctx, config, sourceConn, step)
+		if err != nil {
+			return fmt.Errorf("error planning step %d (%s): %w", i, step.TableName, err)
+		}
+
+		estimatedRows, err := explainRows(ctx, sourceConn, plan.SelectSQL)
+		if err != nil {
+			return fmt.Errorf("error explaining step %d (%s): %w", i, step.TableName, err)
+		}
+
+		fmt.Fprintf(w, "\n## Step %d: %s\n\n", i, step.TableName)
+		fmt.Fprintf(w, "Estimated rows: %d\n", estimatedRows)
+		if step.ChunkBy != "" {
+			chunks, err := planChunks(ctx, sourceConn, step)
+			if err != nil {
+				return fmt.Errorf("error planning chunks of step %d (%s): %w", i, step.TableName, err)
+			}
+			fmt.Fprintf(w, "Chunks: %d by %s\n", len(chunks), step.ChunkBy)
+		}
+		if config.refresh() {
+			if step.upsert(config) {
+				fmt.Fprintf(w, "Refresh: upsert\n")
+			} else {
+				fmt.Fprintf(w, "Refresh: truncate\n")
+			}
+		}
+		if step.BeforeCopySQL != "" {
+			fmt.Fprintf(w, "Before copy SQL:\n%s\n", strings.TrimSpace(step.BeforeCopySQL))
+		}
+		fmt.Fprintf(w, "Source:\n%s\n", plan.CopyToSQL)
+		if plan.GoTransforms != nil {
+			var columnNames []string
+			for j, transform := range plan.GoTransforms {
+				if transform != nil {
+					columnNames = append(columnNames, plan.ColumnNames[j])
+				}
+			}
+			fmt.Fprintf(w, "Go transforms: %s\n", strings.Join(columnNames, ", "))
+		}
+		fmt.Fprintf(w, "Destination:\n%s\n", plan.CopyFromSQL)
+		if step.AfterCopySQL != "" {
+			fmt.Fprintf(w, "After copy SQL:\n%s\n", strings.TrimSpace(step.AfterCopySQL))
+		}
+	}
+
+	return nil
+}
+
+func connectSourceForInspection(ctx context.Context, config *Config) (*pgconn.PgConn, error) {
+	sourceConn, err := pgconn.Connect(ctx, config.Source.DatabaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to source database: %w", err)
+	}
+
+	if config.Source.BeforeTransactionSQL != "" {
+		err := sourceConn.Exec(ctx, config.Source.BeforeTransactionSQL).Close()
+		if err != nil {
+			sourceConn.Close(ctx)
+			return nil, fmt.Errorf("error executing before transaction SQL: %w", err)
+		}
+	}
+
+	err = sourceConn.Exec(ctx, "begin isolation level repeatable read read only").Close()
+	if err != nil {
+		sourceConn.Close(ctx)
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+
+	return sourceConn, nil
+}
+
+func explainRows(ctx context.Context, conn *pgconn.PgConn, selectSQL string) (int64, error) {
+	result := conn.ExecParams(ctx, "explain (format json) "+selectSQL, nil, nil, nil, nil).Read()
+	if result.Err != nil {
+		return 0, result.Err
+	}
+
+	var explain []struct {
+		Plan struct {
+			PlanRows float64 `json:"Plan Rows"`
+		} `json:"Plan"`
+	}
+	err := json.Unmarshal(result.Rows[0][0], &explain)
+	if err != nil {
+		return 0, fmt.Errorf("error decoding explain output: %w", err)
+	}
+	if len(explain) == 0 {
+		return 0, fmt.Errorf("explain output has no plan")
+	}
+
+	return int64(explain[0].Plan.PlanRows), nil
+}
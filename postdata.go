@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"golang.org/x/sync/errgroup"
+)
+
+type postDataEntry struct {
+	Name string
+	Type string
+
+	// SQL begins with the session settings pg_dump had set so it can be executed on any connection.
+	SQL                 string
+	NotValidOnViolation bool
+
+	// TableNames are the tables the entry locks. Entries that lock a common table are not executed concurrently.
+	TableNames []string
+}
+
+var postDataEntryHeaderRegexp = regexp.MustCompile(`^-- Name: (.*); Type: ([^;]*); Schema: `)
+
+func parsePostDataSQL(postDataSQL []byte) []*postDataEntry {
+	var entries []*postDataEntry
+	var entry *postDataEntry
+	var entrySettingsSQL string
+	var settingNames []string
+	settings := make(map[string]string)
+	sb := &strings.Builder{}
+
+	finishEntry := func() {
+		statements := strings.TrimSpace(sb.String())
+		if entry != nil && statements != "" {
+			entry.SQL = entrySettingsSQL + statements + "\n"
+			entries = append(entries, entry)
+		}
+		sb.Reset()
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(postDataSQL))
+	scanner.Buffer(nil, 1024*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if match := postDataEntryHeaderRegexp.FindStringSubmatch(line); match != nil {
+			finishEntry()
+			entry = &postDataEntry{Name: match[1], Type: match[2]}
+			entrySettingsSQL = ""
+			for _, name := range settingNames {
+				entrySettingsSQL += settings[name] + "\n"
+			}
+			continue
+		}
+
+		if line == "--" || strings.HasPrefix(line, "-- ") || strings.HasPrefix(line, `\`) {
+			continue
+		}
+
+		// pg_dump changes session settings such as default_tablespace between entries.
+		if name, ok := postDataSettingName(line); ok {
+			if _, present := settings[name]; !present {
+				settingNames = append(settingNames, name)
+			}
+			settings[name] = line
+			continue
+		}
+
+		if entry != nil {
+			sb.WriteString(line)
+			sb.WriteString("\n")
+		}
+	}
+	finishEntry()
+
+	return entries
+}
+
+var postDataSetConfigRegexp = regexp.MustCompile(`^SELECT pg_catalog\.set_config\('([^']*)'`)
+
+func postDataSettingName(line string) (string, bool) {
+	if rest, found := strings.CutPrefix(line, "SET "); found {
+		name, _, _ := strings.Cut(rest, " ")
+		return name, true
+	}
+	if match := postDataSetConfigRegexp.FindStringSubmatch(line); match != nil {
+		return match[1], true
+	}
+	return "", false
+}
+
+const postDataIdentifierPattern = `(?:"(?:[^"]|"")*"|[^\s."(]+)`
+
+var postDataForeignKeyRegexp = regexp.MustCompile(`(?ms)^ALTER TABLE (?:ONLY )?(` +
+	postDataIdentifierPattern + `(?:\.` + postDataIdentifierPattern + `)?)\s.*?\sREFERENCES (` +
+	postDataIdentifierPattern + `(?:\.` + postDataIdentifierPattern + `)?)\(`)
+
+func postDataForeignKeyTableNames(entrySQL string) []string {
+	match := postDataForeignKeyRegexp.FindStringSubmatch(entrySQL)
+	if match == nil {
+		return nil
+	}
+	return []string{match[1], match[2]}
+}
+
+func loadPostData(ctx context.Context, config *Config, postDataSQL []byte) error {
+	var indexEntries, otherEntries, foreignKeyEntries []*postDataEntry
+	for _, entry := range parsePostDataSQL(postDataSQL) {
+		switch entry.Type {
+		case "INDEX", "CONSTRAINT":
+			indexEntries = append(indexEntries, entry)
+		case "FK CONSTRAINT":
+			foreignKeyEntries = append(foreignKeyEntries, entry)
+		default:
+			otherEntries = append(otherEntries, entry)
+		}
+	}
+
+	parallelism := max(config.Parallelism, 1)
+	conns := make([]*pgconn.PgConn, 0, parallelism)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close(ctx)
+		}
+	}()
+	for len(conns) < parallelism {
+		conn, err := pgconn.Connect(ctx, config.Destination.DatabaseURL)
+		if err != nil {
+			return fmt.Errorf("error connecting to destination database: %w", err)
+		}
+		conns = append(conns, conn)
+	}
+
+	err := execPostDataEntries(ctx, conns, indexEntries, config.Resume)
+	if err != nil {
+		return err
+	}
+	slog.Info("Created indexes and constraints", "count", len(indexEntries))
+
+	for _, entry := range otherEntries {
+		err := execPostDataEntry(ctx, conns[0], entry, config.Resume)
+		if err != nil {
+			slog.Warn("Unable to create object", "error", err)
+		}
+	}
+
+	start := time.Now()
+	if config.createForeignKeysNotValid() {
+		for _, entry := range foreignKeyEntries {
+			entry.NotValidOnViolation = true
+		}
+	}
+	foreignKeyConns := conns
+	for _, entry := range foreignKeyEntries {
+		entry.TableNames = postDataForeignKeyTableNames(entry.SQL)
+		if entry.TableNames == nil {
+			// Without its tables the constraint could deadlock with another, so the constraints are created one at a time.
+			foreignKeyConns = conns[:1]
+		}
+	}
+	err = execPostDataEntries(ctx, foreignKeyConns, foreignKeyEntries, config.Resume)
+	if err != nil {
+		return err
+	}
+	config.report.recordPhase("foreign_keys", start)
+	slog.Info("Created foreign key constraints", "count", len(foreignKeyEntries))
+
+	return nil
+}
+
+func execPostDataEntries(ctx context.Context, conns []*pgconn.PgConn, entries []*postDataEntry, resume bool) error {
+	g, ctx := errgroup.WithContext(ctx)
+
+	var mux sync.Mutex
+	cond := sync.NewCond(&mux)
+	pending := slices.Clone(entries)
+	lockedTableNames := make(map[string]int)
+	failed := false
+
+	next := func() *postDataEntry {
+		mux.Lock()
+		defer mux.Unlock()
+		for !failed && len(pending) > 0 {
+			for i, entry := range pending {
+				locked := slices.ContainsFunc(entry.TableNames, func(tableName string) bool { return lockedTableNames[tableName] > 0 })
+				if !locked {
+					pending = slices.Delete(pending, i, i+1)
+					for _, tableName := range entry.TableNames {
+						lockedTableNames[tableName]++
+					}
+					return entry
+				}
+			}
+			cond.Wait()
+		}
+		return nil
+	}
+
+	finish := func(entry *postDataEntry, err error) {
+		mux.Lock()
+		defer mux.Unlock()
+		for _, tableName := range entry.TableNames {
+			lockedTableNames[tableName]--
+		}
+		if err != nil {
+			failed = true
+		}
+		cond.Broadcast()
+	}
+
+	for _, conn := range conns {
+		g.Go(func() error {
+			for entry := next(); entry != nil; entry = next() {
+				err := execPostDataEntry(ctx, conn, entry, resume)
+				finish(entry, err)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	return g.Wait()
+}
+
+func execPostDataEntry(ctx context.Context, conn *pgconn.PgConn, entry *postDataEntry, resume bool) error {
+	err := conn.Exec(ctx, entry.SQL).Close()
+	if entry.NotValidOnViolation && isForeignKeyViolation(err) {
+		slog.Warn("Created foreign key constraint as not valid", "constraint", entry.Name, "error", err)
+		notValidSQL := strings.TrimSuffix(strings.TrimSpace(entry.SQL), ";") + " NOT VALID;\n"
+		err = conn.Exec(ctx, notValidSQL).Close()
+	}
+	if err != nil {
+		// 42P07 is duplicate_table which is also used for indexes. 42710 is duplicate_object. 42P16 is
+		// invalid_table_definition which is used when a primary key already exists.
+		var pgErr *pgconn.PgError
+		if resume && errors.As(err, &pgErr) && (pgErr.Code == "42P07" || pgErr.Code == "42710" || pgErr.Code == "42P16") {
+			return nil
+		}
+		return fmt.Errorf("error creating %s %s: %w", strings.ToLower(entry.Type), entry.Name, err)
+	}
+
+	return nil
+}
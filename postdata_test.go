@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePostDataSQL(t *testing.T) {
+	postDataSQL := `--
+-- PostgreSQL database dump
+--
+
+\restrict abc123
+
+-- Dumped from database version 17.6
+-- Dumped by pg_dump version 17.6
+
+SET statement_timeout = 0;
+SET client_encoding = 'UTF8';
+SELECT pg_catalog.set_config('search_path', '', false);
+
+SET default_tablespace = '';
+
+--
+-- Name: a a_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.a
+    ADD CONSTRAINT a_pkey PRIMARY KEY (id);
+
+
+SET default_tablespace = fast;
+
+--
+-- Name: a_name_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX a_name_idx ON public.a USING btree (name);
+
+
+--
+-- Name: b b_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.b
+    ADD CONSTRAINT b_id_fkey FOREIGN KEY (id) REFERENCES public.a(id);
+
+
+--
+-- PostgreSQL database dump complete
+--
+
+\unrestrict abc123
+
+`
+
+	entries := parsePostDataSQL([]byte(postDataSQL))
+	require.Len(t, entries, 3)
+
+	require.Equal(t, "a a_pkey", entries[0].Name)
+	require.Equal(t, "CONSTRAINT", entries[0].Type)
+	require.Equal(t, `SET statement_timeout = 0;
+SET client_encoding = 'UTF8';
+SELECT pg_catalog.set_config('search_path', '', false);
+SET default_tablespace = '';
+ALTER TABLE ONLY public.a
+    ADD CONSTRAINT a_pkey PRIMARY KEY (id);
+`, entries[0].SQL)
+
+	require.Equal(t, "a_name_idx", entries[1].Name)
+	require.Equal(t, "INDEX", entries[1].Type)
+	require.Equal(t, `SET statement_timeout = 0;
+SET client_encoding = 'UTF8';
+SELECT pg_catalog.set_config('search_path', '', false);
+SET default_tablespace = fast;
+CREATE INDEX a_name_idx ON public.a USING btree (name);
+`, entries[1].SQL)
+
+	require.Equal(t, "b b_id_fkey", entries[2].Name)
+	require.Equal(t, "FK CONSTRAINT", entries[2].Type)
+	require.Contains(t, entries[2].SQL, "SET default_tablespace = fast;\nALTER TABLE ONLY public.b\n")
+}
+
+func TestPostDataForeignKeyTableNames(t *testing.T) {
+	require.Equal(t, []string{"public.b", "public.a"}, postDataForeignKeyTableNames(`SET default_tablespace = '';
+ALTER TABLE ONLY public.b
+    ADD CONSTRAINT b_id_fkey FOREIGN KEY (id) REFERENCES public.a(id);
+`))
+	require.Equal(t, []string{`"special characters"."Foo bar"`, `"Other ""quoted"""`}, postDataForeignKeyTableNames(`ALTER TABLE "special characters"."Foo bar"
+    ADD CONSTRAINT "Foo bar_other_fkey" FOREIGN KEY (other_id) REFERENCES "Other ""quoted"""(id) ON DELETE CASCADE;
+`))
+	require.Nil(t, postDataForeignKeyTableNames("CREATE TRIGGER t AFTER INSERT ON public.a FOR EACH ROW EXECUTE FUNCTION f();\n"))
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	progressTerminalInterval = time.Second
+
+	progressLogInterval = 10 * time.Second
+
+	// Longer lines would wrap and could not be cleared.
+	progressLineWidth = 79
+)
+
+type stepProgress struct {
+	idx                     int
+	tableName               string
+	estimatedRows           int64
+	rows                    atomic.Int64
+	bytes                   atomic.Int64
+	copiedRows              atomic.Int64
+	mux                     sync.Mutex
+	startTime               time.Time
+	finishTime              time.Time
+	skipped                 bool
+	beforeCopySQLDuration   time.Duration
+	afterCopySQLDuration    time.Duration
+	afterCopySQLRemovedRows int64
+}
+
+func (sp *stepProgress) start() {
+	if sp == nil {
+		return
+	}
+	sp.mux.Lock()
+	defer sp.mux.Unlock()
+	if sp.startTime.IsZero() {
+		sp.startTime = time.Now()
+	}
+}
+
+func (sp *stepProgress) finish() {
+	if sp == nil {
+		return
+	}
+	sp.mux.Lock()
+	defer sp.mux.Unlock()
+	sp.finishTime = time.Now()
+}
+
+func (sp *stepProgress) skip() {
+	if sp == nil {
+		return
+	}
+	sp.mux.Lock()
+	defer sp.mux.Unlock()
+	sp.skipped = true
+}
+
+func (sp *stepProgress) countCopiedRows(commandTag pgconn.CommandTag) {
+	if sp == nil {
+		return
+	}
+	sp.copiedRows.Add(commandTag.RowsAffected())
+}
+
+func (sp *stepProgress) recordSQLDurations(beforeCopySQLDuration, afterCopySQLDuration time.Duration) {
+	if sp == nil {
+		return
+	}
+	sp.mux.Lock()
+	defer sp.mux.Unlock()
+	sp.beforeCopySQLDuration = beforeCopySQLDuration
+	sp.afterCopySQLDuration = afterCopySQLDuration
+}
+
+func (sp *stepProgress) recordAfterCopySQLRemovedRows(n int64) {
+	if sp == nil {
+		return
+	}
+	sp.mux.Lock()
+	defer sp.mux.Unlock()
+	sp.afterCopySQLRemovedRows = n
+}
+
+func (sp *stepProgress) running(now time.Time) (bool, time.Duration) {
+	sp.mux.Lock()
+	defer sp.mux.Unlock()
+	if sp.startTime.IsZero() || !sp.finishTime.IsZero() {
+		return false, 0
+	}
+	return true, now.Sub(sp.startTime)
+}
+
+type stepProgressStatus struct {
+	rows           int64
+	bytes          int64
+	rowsPerSecond  float64
+	bytesPerSecond float64
+	hasEstimate    bool
+	percent        float64
+	eta            time.Duration
+}
+
+func (sp *stepProgress) status(elapsed time.Duration) stepProgressStatus {
+	s := stepProgressStatus{rows: sp.rows.Load(), bytes: sp.bytes.Load()}
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		s.rowsPerSecond = float64(s.rows) / seconds
+		s.bytesPerSecond = float64(s.bytes) / seconds
+	}
+
+	if sp.estimatedRows > 0 {
+		s.hasEstimate = true
+		// The estimate can be low, so a running step never claims to be done.
+		s.percent = min(float64(s.rows)/float64(sp.estimatedRows)*100, 99)
+		if s.rowsPerSecond > 0 {
+			remaining := max(sp.estimatedRows-s.rows, 0)
+			s.eta = time.Duration(float64(remaining) / s.rowsPerSecond * float64(time.Second)).Round(time.Second)
+		}
+	}
+
+	return s
+}
+
+type progressWriter struct {
+	w        io.Writer
+	progress *stepProgress
+	binary   *binaryCopyRowCounter
+	rows     int64
+	bytes    int64
+}
+
+func newProgressWriter(w io.Writer, progress *stepProgress, format string) *progressWriter {
+	pw := &progressWriter{w: w, progress: progress}
+	if format == "binary" {
+		pw.binary = &binaryCopyRowCounter{}
+	}
+	return pw
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+
+	var rows int64
+	if pw.binary != nil {
+		rows = pw.binary.count(p[:n])
+	} else {
+		rows = int64(bytes.Count(p[:n], []byte{'\n'}))
+	}
+	pw.rows += rows
+	pw.bytes += int64(n)
+	pw.progress.rows.Add(rows)
+	pw.progress.bytes.Add(int64(n))
+
+	return n, err
+}
+
+func (pw *progressWriter) discount() {
+	pw.progress.rows.Add(-pw.rows)
+	pw.progress.bytes.Add(-pw.bytes)
+	pw.rows = 0
+	pw.bytes = 0
+}
+
+const (
+	binaryCopyHeader = iota
+	binaryCopyTuple
+	binaryCopyField
+	binaryCopyTrailer
+)
+
+const binaryCopyHeaderLen = 19
+
+type binaryCopyRowCounter struct {
+	state  int
+	buf    []byte
+	skip   int64
+	fields int
+}
+
+func (c *binaryCopyRowCounter) count(p []byte) int64 {
+	var rows int64
+	for len(p) > 0 {
+		if c.state == binaryCopyTrailer {
+			return rows
+		}
+
+		if c.skip > 0 {
+			n := min(c.skip, int64(len(p)))
+			c.skip -= n
+			p = p[n:]
+			continue
+		}
+
+		var need int
+		switch c.state {
+		case binaryCopyHeader:
+			need = binaryCopyHeaderLen
+		case binaryCopyTuple:
+			need = 2
+		case binaryCopyField:
+			need = 4
+		}
+		n := min(need-len(c.buf), len(p))
+		c.buf = append(c.buf, p[:n]...)
+		p = p[n:]
+		if len(c.buf) < need {
+			return rows
+		}
+
+		switch c.state {
+		case binaryCopyHeader:
+			c.skip = int64(binary.BigEndian.Uint32(c.buf[15:]))
+			c.state = binaryCopyTuple
+		case binaryCopyTuple:
+			fields := int16(binary.BigEndian.Uint16(c.buf))
+			if fields == -1 {
+				c.state = binaryCopyTrailer
+			} else {
+				rows++
+				c.fields = int(fields)
+				c.nextField()
+			}
+		case binaryCopyField:
+			length := int32(binary.BigEndian.Uint32(c.buf))
+			c.skip = max(int64(length), 0)
+			c.fields--
+			c.nextField()
+		}
+		c.buf = c.buf[:0]
+	}
+
+	return rows
+}
+
+func (c *binaryCopyRowCounter) nextField() {
+	if c.fields > 0 {
+		c.state = binaryCopyField
+	} else {
+		c.state = binaryCopyTuple
+	}
+}
+
+type progressReporter struct {
+	steps     []*stepProgress
+	terminal  bool
+	mux       sync.Mutex
+	lineCount int
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+func newProgressReporter(ctx context.Context, conn *pgconn.PgConn, steps []*Step) (*progressReporter, error) {
+	pr := &progressReporter{
+		steps:    make([]*stepProgress, len(steps)),
+		terminal: isTerminal(os.Stderr),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	for i, step := range steps {
+		result := conn.ExecParams(ctx,
+			"select reltuples::int8 from pg_class where oid = to_regclass($1)",
+			[][]byte{[]byte(step.TableName)}, nil, nil, nil,
+		).Read()
+		if result.Err != nil {
+			return nil, fmt.Errorf("error getting row count estimate of %s: %w", step.TableName, result.Err)
+		}
+
+		// reltuples is -1 for a table that has never been vacuumed or analyzed.
+		estimatedRows := int64(-1)
+		if len(result.Rows) == 1 {
+			estimatedRows, _ = strconv.ParseInt(string(result.Rows[0][0]), 10, 64)
+		}
+
+		step.progress = &stepProgress{idx: i, tableName: step.TableName, estimatedRows: estimatedRows}
+		pr.steps[i] = step.progress
+	}
+
+	return pr, nil
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+func (pr *progressReporter) start() {
+	interval := progressLogInterval
+	if pr.terminal {
+		interval = progressTerminalInterval
+		// Log messages are written through pr so the progress display can be cleared and redrawn around them.
+		log.SetOutput(pr)
+	}
+
+	go func() {
+		defer close(pr.stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				pr.report()
+			case <-pr.done:
+				return
+			}
+		}
+	}()
+}
+
+func (pr *progressReporter) stop() {
+	close(pr.done)
+	<-pr.stopped
+
+	if pr.terminal {
+		pr.mux.Lock()
+		pr.clear()
+		pr.mux.Unlock()
+		log.SetOutput(os.Stderr)
+	}
+}
+
+func (pr *progressReporter) report() {
+	now := time.Now()
+
+	if !pr.terminal {
+		for _, sp := range pr.steps {
+			running, elapsed := sp.running(now)
+			if !running {
+				continue
+			}
+			s := sp.status(elapsed)
+			args := []any{
+				"idx", sp.idx,
+				"table_name", sp.tableName,
+				"rows", s.rows,
+				"bytes", s.bytes,
+				"rows_per_second", math.Round(s.rowsPerSecond),
+				"mb_per_second", math.Round(s.bytesPerSecond/1e5) / 10,
+			}
+			if s.hasEstimate {
+				args = append(args, "percent", math.Round(s.percent), "eta", s.eta.String())
+			}
+			slog.Info("Progress", args...)
+		}
+		return
+	}
+
+	pr.mux.Lock()
+	defer pr.mux.Unlock()
+	pr.clear()
+	pr.draw(now)
+}
+
+func (pr *progressReporter) Write(p []byte) (int, error) {
+	pr.mux.Lock()
+	defer pr.mux.Unlock()
+
+	pr.clear()
+	n, err := os.Stderr.Write(p)
+	pr.draw(time.Now())
+	return n, err
+}
+
+func (pr *progressReporter) clear() {
+	if pr.lineCount == 0 {
+		return
+	}
+	s := "\r"
+	if pr.lineCount > 1 {
+		s += fmt.Sprintf("\x1b[%dA", pr.lineCount-1)
+	}
+	s += "\x1b[J"
+	os.Stderr.WriteString(s)
+	pr.lineCount = 0
+}
+
+func (pr *progressReporter) draw(now time.Time) {
+	var lines []string
+	for _, sp := range pr.steps {
+		running, elapsed := sp.running(now)
+		if running {
+			lines = append(lines, formatProgressLine(sp, sp.status(elapsed)))
+		}
+	}
+	if len(lines) == 0 {
+		return
+	}
+
+	os.Stderr.WriteString(strings.Join(lines, "\n"))
+	pr.lineCount = len(lines)
+}
+
+func formatProgressLine(sp *stepProgress, s stepProgressStatus) string {
+	line := fmt.Sprintf("%d %s: %s rows", sp.idx, sp.tableName, formatCount(float64(s.rows)))
+	if s.hasEstimate {
+		line += fmt.Sprintf(" %.0f%%", s.percent)
+	}
+	line += fmt.Sprintf(" %s %s rows/s %s/s", formatBytes(float64(s.bytes)), formatCount(s.rowsPerSecond), formatBytes(s.bytesPerSecond))
+	if s.hasEstimate && s.rowsPerSecond > 0 {
+		line += " ETA " + s.eta.String()
+	}
+
+	if runes := []rune(line); len(runes) > progressLineWidth {
+		line = string(runes[:progressLineWidth-3]) + "..."
+	}
+	return line
+}
+
+func formatCount(n float64) string {
+	switch {
+	case n >= 1e9:
+		return fmt.Sprintf("%.1fB", n/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.1fM", n/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.1fk", n/1e3)
+	default:
+		return fmt.Sprintf("%.0f", n)
+	}
+}
+
+func formatBytes(n float64) string {
+	switch {
+	case n >= 1e9:
+		return fmt.Sprintf("%.1f GB", n/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.1f MB", n/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.1f kB", n/1e3)
+	default:
+		return fmt.Sprintf("%.0f B", n)
+	}
+}
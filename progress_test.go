@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgressWriterText(t *testing.T) {
+	sp := &stepProgress{}
+	buf := &bytes.Buffer{}
+	pw := newProgressWriter(buf, sp, "text")
+
+	for _, s := range []string{"1\tline\\nbreak\n2\t", "\\N\n", "3\tx\n"} {
+		_, err := pw.Write([]byte(s))
+		require.NoError(t, err)
+	}
+	require.EqualValues(t, 3, sp.rows.Load())
+	require.EqualValues(t, buf.Len(), sp.bytes.Load())
+
+	pw.discount()
+	require.EqualValues(t, 0, sp.rows.Load())
+	require.EqualValues(t, 0, sp.bytes.Load())
+}
+
+func TestBinaryCopyRowCounter(t *testing.T) {
+	data := []byte("PGCOPY\n\xff\r\n\x00")
+	data = binary.BigEndian.AppendUint32(data, 0)
+	data = binary.BigEndian.AppendUint32(data, 3)
+	data = append(data, "ext"...)
+	for i := range 3 {
+		data = binary.BigEndian.AppendUint16(data, 2)
+		data = binary.BigEndian.AppendUint32(data, 4)
+		data = binary.BigEndian.AppendUint32(data, uint32(i))
+		data = binary.BigEndian.AppendUint32(data, 0xffffffff)
+	}
+	data = binary.BigEndian.AppendUint16(data, 0xffff)
+
+	for _, size := range []int{1, 2, 3, 7, len(data)} {
+		c := &binaryCopyRowCounter{}
+		var rows int64
+		for p := data; len(p) > 0; {
+			n := min(size, len(p))
+			rows += c.count(p[:n])
+			p = p[n:]
+		}
+		require.EqualValues(t, 3, rows, "size %d", size)
+		require.Equal(t, binaryCopyTrailer, c.state, "size %d", size)
+	}
+}
+
+func TestStepProgressStatus(t *testing.T) {
+	sp := &stepProgress{idx: 3, tableName: "users", estimatedRows: 1000}
+	sp.rows.Store(250)
+	sp.bytes.Store(5_000_000)
+
+	s := sp.status(10 * time.Second)
+	require.True(t, s.hasEstimate)
+	require.EqualValues(t, 25, s.percent)
+	require.EqualValues(t, 25, s.rowsPerSecond)
+	require.Equal(t, 30*time.Second, s.eta)
+	require.Equal(t, "3 users: 250 rows 25% 5.0 MB 25 rows/s 500.0 kB/s ETA 30s", formatProgressLine(sp, s))
+
+	sp.rows.Store(2000)
+	require.EqualValues(t, 99, sp.status(10*time.Second).percent)
+
+	sp.estimatedRows = -1
+	s = sp.status(10 * time.Second)
+	require.False(t, s.hasEstimate)
+	require.Equal(t, "3 users: 2.0k rows 5.0 MB 200 rows/s 500.0 kB/s", formatProgressLine(sp, s))
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func (config *Config) refresh() bool {
+	return config.Destination.Mode == "refresh"
+}
+
+func (step *Step) upsert(config *Config) bool {
+	return config.refresh() && step.Refresh == "upsert"
+}
+
+func (config *Config) validateRefresh() error {
+	switch config.Destination.Mode {
+	case "", "rebuild", "refresh":
+	default:
+		return fmt.Errorf("unknown destination.mode: %s", config.Destination.Mode)
+	}
+
+	for i, step := range config.Steps {
+		switch step.Refresh {
+		case "":
+		case "truncate", "upsert":
+			if !config.refresh() {
+				return fmt.Errorf("step %d (%s): refresh requires destination.mode to be refresh", i, step.TableName)
+			}
+		default:
+			return fmt.Errorf("step %d (%s): unknown refresh: %s", i, step.TableName, step.Refresh)
+		}
+	}
+
+	return nil
+}
+
+func dropForeignKeyConstraints(ctx context.Context, conn *pgconn.PgConn, steps []*Step) ([]*foreignKey, error) {
+	tableNames := make(map[string]bool, len(steps))
+	for _, step := range steps {
+		tableName, err := resolveTableName(ctx, conn, step.TableName)
+		if err != nil {
+			return nil, err
+		}
+		if tableName != "" {
+			tableNames[tableName] = true
+		}
+	}
+
+	foreignKeys, err := getForeignKeys(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var droppedForeignKeys []*foreignKey
+
+	for _, fk := range foreignKeys {
+		if !tableNames[fk.TableName] && !tableNames[fk.ReferencedTableName] {
+			continue
+		}
+
+		dropConstraintSQL := fmt.Sprintf("alter table %s drop constraint %s", fk.TableName, fk.Name)
+		result := conn.ExecParams(ctx, dropConstraintSQL, nil, nil, nil, nil).Read()
+		if result.Err != nil {
+			return nil, result.Err
+		}
+
+		droppedForeignKeys = append(droppedForeignKeys, fk)
+	}
+
+	return droppedForeignKeys, nil
+}
+
+func recreateForeignKeyConstraints(ctx context.Context, conn *pgconn.PgConn, foreignKeys []*foreignKey, notValid bool) error {
+	for _, fk := range foreignKeys {
+		cmd := fk.addConstraintSQL()
+		err := conn.Exec(ctx, cmd).Close()
+		if notValid && isForeignKeyViolation(err) {
+			slog.Warn("Recreated foreign key constraint as not valid", "command", cmd, "error", err)
+			err = conn.Exec(ctx, cmd+" not valid").Close()
+		}
+		if err != nil {
+			return fmt.Errorf("error creating foreign key constraint %s: %w", fk.Name, err)
+		}
+	}
+	return nil
+}
+
+func isForeignKeyViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23503"
+}
+
+func loadRows(ctx context.Context, config *Config, sourceConn, destinationConn *pgconn.PgConn, step *Step, plan *stepCopyPlan) error {
+	if step.upsert(config) {
+		return upsertRows(ctx, sourceConn, destinationConn, step, plan)
+	}
+	return copyRows(ctx, sourceConn, destinationConn, plan)
+}
+
+func upsertRows(ctx context.Context, sourceConn, destinationConn *pgconn.PgConn, step *Step, plan *stepCopyPlan) error {
+	tableName, err := resolveTableName(ctx, destinationConn, step.TableName)
+	if err != nil {
+		return err
+	}
+	if tableName == "" {
+		return fmt.Errorf("table %s does not exist in destination", step.TableName)
+	}
+
+	columnNames := plan.DestinationColumnNames
+	if columnNames == nil {
+		columns, err := getTableColumns(ctx, destinationConn, tableName)
+		if err != nil {
+			return err
+		}
+		for _, column := range columns {
+			if !column.Generated {
+				columnNames = append(columnNames, pgx.Identifier{column.Name}.Sanitize())
+			}
+		}
+	}
+
+	result := destinationConn.ExecParams(ctx, `select a.attname
+from pg_index i
+  join pg_attribute a on a.attrelid = i.indrelid and a.attnum = any(i.indkey)
+where i.indrelid = $1::regclass
+  and i.indisprimary
+order by array_position(i.indkey::int2[], a.attnum)`, [][]byte{[]byte(tableName)}, nil, nil, nil).Read()
+	if result.Err != nil {
+		return fmt.Errorf("error getting primary key of %s: %w", tableName, result.Err)
+	}
+	if len(result.Rows) == 0 {
+		return fmt.Errorf("refresh upsert requires %s to have a primary key", tableName)
+	}
+	primaryKeyColumnNames := make([]string, len(result.Rows))
+	isPrimaryKeyColumn := make(map[string]bool, len(result.Rows))
+	for i, row := range result.Rows {
+		primaryKeyColumnNames[i] = pgx.Identifier{string(row[0])}.Sanitize()
+		isPrimaryKeyColumn[string(row[0])] = true
+	}
+
+	columnList := strings.Join(columnNames, ", ")
+	err = destinationConn.Exec(ctx, fmt.Sprintf(
+		"drop table if exists pg_partialcopy_staging; create temporary table pg_partialcopy_staging as select %s from %s with no data",
+		columnList, tableName,
+	)).Close()
+	if err != nil {
+		return fmt.Errorf("error creating staging table: %w", err)
+	}
+
+	stagingPlan := *plan
+	stagingPlan.CopyFromSQL = fmt.Sprintf("copy pg_partialcopy_staging (%s) from stdin", columnList)
+	if plan.Format == "binary" {
+		stagingPlan.CopyFromSQL += " with (format binary)"
+	}
+	err = copyRows(ctx, sourceConn, destinationConn, &stagingPlan)
+	if err != nil {
+		return err
+	}
+
+	var assignments []string
+	for _, columnName := range columnNames {
+		if !isPrimaryKeyColumn[unquoteIdentifier(columnName)] {
+			assignments = append(assignments, fmt.Sprintf("%s = excluded.%s", columnName, columnName))
+		}
+	}
+	onConflict := "do nothing"
+	if len(assignments) > 0 {
+		onConflict = "do update set " + strings.Join(assignments, ", ")
+	}
+
+	// overriding system value allows copying to identity columns that are generated always.
+	err = destinationConn.Exec(ctx, fmt.Sprintf(
+		"insert into %s (%s) overriding system value select %s from pg_partialcopy_staging on conflict (%s) %s; drop table pg_partialcopy_staging",
+		tableName, columnList, columnList, strings.Join(primaryKeyColumnNames, ", "), onConflict,
+	)).Close()
+	if err != nil {
+		return fmt.Errorf("error upserting rows: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"time"
+)
+
+const (
+	reportStatusSucceeded = "succeeded"
+	reportStatusFailed    = "failed"
+
+	reportStepCompleted  = "completed"
+	reportStepFailed     = "failed"
+	reportStepSkipped    = "skipped"
+	reportStepNotStarted = "not_started"
+)
+
+type runReport struct {
+	Status          string             `json:"status"`
+	Error           string             `json:"error,omitempty"`
+	StartedAt       time.Time          `json:"started_at"`
+	FinishedAt      time.Time          `json:"finished_at"`
+	DurationSeconds float64            `json:"duration_seconds"`
+	SnapshotID      string             `json:"snapshot_id,omitempty"`
+	PhaseSeconds    map[string]float64 `json:"phase_seconds"`
+	Steps           []*stepReport      `json:"steps"`
+}
+
+type stepReport struct {
+	TableName               string  `json:"table_name"`
+	Status                  string  `json:"status"`
+	Rows                    int64   `json:"rows"`
+	Bytes                   int64   `json:"bytes"`
+	DurationSeconds         float64 `json:"duration_seconds"`
+	BeforeCopySQLSeconds    float64 `json:"before_copy_sql_seconds"`
+	AfterCopySQLSeconds     float64 `json:"after_copy_sql_seconds"`
+	AfterCopySQLRemovedRows int64   `json:"after_copy_sql_removed_rows,omitempty"`
+}
+
+func newRunReport() *runReport {
+	return &runReport{StartedAt: time.Now(), PhaseSeconds: make(map[string]float64)}
+}
+
+func (r *runReport) recordPhase(phase string, start time.Time) {
+	if r == nil {
+		return
+	}
+	r.PhaseSeconds[phase] = reportSeconds(time.Duration(r.PhaseSeconds[phase]*float64(time.Second)) + time.Since(start))
+}
+
+func (r *runReport) finish(steps []*Step, output bool, runErr error) {
+	r.FinishedAt = time.Now()
+	r.DurationSeconds = reportSeconds(r.FinishedAt.Sub(r.StartedAt))
+	r.Status = reportStatusSucceeded
+	if runErr != nil {
+		r.Status = reportStatusFailed
+		r.Error = runErr.Error()
+	}
+
+	r.Steps = make([]*stepReport, len(steps))
+	for i, step := range steps {
+		sr := &stepReport{TableName: step.TableName, Status: reportStepNotStarted}
+		r.Steps[i] = sr
+
+		sp := step.progress
+		if sp == nil {
+			continue
+		}
+
+		sp.mux.Lock()
+		switch {
+		case sp.skipped:
+			sr.Status = reportStepSkipped
+		case !sp.finishTime.IsZero():
+			sr.Status = reportStepCompleted
+			sr.DurationSeconds = reportSeconds(sp.finishTime.Sub(sp.startTime))
+		case !sp.startTime.IsZero():
+			sr.Status = reportStepFailed
+			sr.DurationSeconds = reportSeconds(r.FinishedAt.Sub(sp.startTime))
+		}
+		sr.BeforeCopySQLSeconds = reportSeconds(sp.beforeCopySQLDuration)
+		sr.AfterCopySQLSeconds = reportSeconds(sp.afterCopySQLDuration)
+		sr.AfterCopySQLRemovedRows = sp.afterCopySQLRemovedRows
+		sp.mux.Unlock()
+
+		sr.Bytes = sp.bytes.Load()
+		if output {
+			sr.Rows = sp.rows.Load()
+		} else {
+			sr.Rows = sp.copiedRows.Load()
+		}
+	}
+}
+
+func (r *runReport) write(path string) error {
+	buf, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	err = os.WriteFile(path, buf, 0644)
+	if err != nil {
+		return fmt.Errorf("error writing report: %w", err)
+	}
+
+	return nil
+}
+
+func reportSeconds(d time.Duration) float64 {
+	return math.Round(d.Seconds()*1000) / 1000
+}
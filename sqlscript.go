@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+type sqlScriptOutput struct {
+	*stepFiles
+
+	path string
+}
+
+func newSQLScriptOutput(path string) (*sqlScriptOutput, error) {
+	sf, err := newStepFiles(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqlScriptOutput{stepFiles: sf, path: path}, nil
+}
+
+func (o *sqlScriptOutput) writeStep(ctx context.Context, sourceConn *pgconn.PgConn, task stepTask, step *Step, plan *stepCopyPlan) error {
+	return o.write(task, step, plan, func(w io.Writer) error {
+		_, err := writeRows(ctx, sourceConn, w, plan)
+		return err
+	})
+}
+
+func (o *sqlScriptOutput) finish(structure *sourceStructure) error {
+	err := writeFile(o.path, func(f io.Writer) error {
+		w := bufio.NewWriter(f)
+
+		fmt.Fprintf(w, "--\n-- Written by pg_partialcopy from snapshot %s. Load with psql -f.\n--\n\n", structure.SnapshotID)
+		w.Write(structure.PreDataSQL)
+
+		// pre-data clears search_path. The steps use the same search_path as a copy to a database.
+		fmt.Fprintf(w, "\nRESET search_path;\n\n")
+
+		for _, value := range structure.SequenceValues {
+			if value.LastValue != nil {
+				fmt.Fprintf(w, "SELECT pg_catalog.setval(%s, %d, true);\n", quoteLiteral(value.Name), *value.LastValue)
+			}
+		}
+
+		for i, as := range o.sortedSteps() {
+			fmt.Fprintf(w, "\n--\n-- Step %d: %s\n--\n\n", i, as.TableName)
+			writeSQLStatement(w, as.BeforeCopySQL)
+			for _, name := range as.Files {
+				fmt.Fprintf(w, "%s;\n", as.CopyFromSQL)
+				err := copyFileTo(w, o.filePath(name))
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(w, "\\.\n")
+			}
+			writeSQLStatement(w, as.AfterCopySQL)
+		}
+
+		fmt.Fprintf(w, "\n")
+		w.Write(structure.PostDataSQL)
+
+		return w.Flush()
+	})
+	if err != nil {
+		return fmt.Errorf("error writing SQL script: %w", err)
+	}
+	slog.Info("Wrote SQL script", "path", o.path)
+
+	return nil
+}
+
+func writeSQLStatement(w io.Writer, sql string) {
+	sql = strings.TrimSpace(sql)
+	if sql == "" {
+		return
+	}
+	if !strings.HasSuffix(sql, ";") {
+		sql += ";"
+	}
+	fmt.Fprintf(w, "%s\n", sql)
+}
+
+func copyFileTo(w io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(w, file)
+	return err
+}
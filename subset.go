@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+type subsetEdge struct {
+	fk        *foreignKey
+	tableName string
+}
+
+type subsetCTE struct {
+	name string
+	sql  string
+	deps []string
+}
+
+func expandSubsetSteps(ctx context.Context, conn *pgconn.PgConn, steps []*Step) ([]*Step, error) {
+	var rootSteps []*Step
+	for _, step := range steps {
+		if step.Where != "" {
+			if step.SelectSQL != "" {
+				return nil, fmt.Errorf("step %s: where and select_sql cannot both be set", step.TableName)
+			}
+			rootSteps = append(rootSteps, step)
+		} else if step.IncludeChildren {
+			return nil, fmt.Errorf("step %s: include_children requires where", step.TableName)
+		}
+	}
+	if len(rootSteps) == 0 {
+		return steps, nil
+	}
+
+	foreignKeys, err := getForeignKeys(ctx, conn)
+	if err != nil {
+		return nil, fmt.Errorf("error getting foreign keys: %w", err)
+	}
+
+	stepTableNames := make(map[*Step]string, len(steps))
+	configuredTables := make(map[string]bool, len(steps))
+	for _, step := range steps {
+		tableName, err := resolveTableName(ctx, conn, step.TableName)
+		if err != nil {
+			return nil, err
+		}
+		if tableName == "" {
+			if step.Where != "" {
+				return nil, fmt.Errorf("step %s: table does not exist in source", step.TableName)
+			}
+			continue
+		}
+		stepTableNames[step] = tableName
+		configuredTables[tableName] = true
+	}
+
+	rootWheres := make(map[string]string, len(rootSteps))
+	downTables := make(map[string]bool)
+	var queue []string
+	for _, step := range rootSteps {
+		tableName := stepTableNames[step]
+		if _, present := rootWheres[tableName]; present {
+			return nil, fmt.Errorf("step %s: table is the root of more than one subset", step.TableName)
+		}
+		rootWheres[tableName] = step.Where
+		downTables[tableName] = true
+		if step.IncludeChildren {
+			queue = append(queue, tableName)
+		}
+	}
+
+	// Walk foreign keys down to the child tables of roots with include_children.
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+		for _, fk := range foreignKeys {
+			if fk.ReferencedTableName == parent && !downTables[fk.TableName] {
+				downTables[fk.TableName] = true
+				queue = append(queue, fk.TableName)
+			}
+		}
+	}
+
+	// Walk foreign keys up to every table whose rows may be required to satisfy a foreign key.
+	closureTables := make(map[string]bool, len(downTables))
+	for tableName := range downTables {
+		closureTables[tableName] = true
+		queue = append(queue, tableName)
+	}
+	for len(queue) > 0 {
+		child := queue[0]
+		queue = queue[1:]
+		for _, fk := range foreignKeys {
+			if fk.TableName == child && !closureTables[fk.ReferencedTableName] {
+				closureTables[fk.ReferencedTableName] = true
+				queue = append(queue, fk.ReferencedTableName)
+			}
+		}
+	}
+
+	// A table in downTables depends on the tables it references. A table in closureTables depends on the tables that
+	// reference it.
+	downEdges := make(map[string][]subsetEdge)
+	upEdges := make(map[string][]subsetEdge)
+	for _, fk := range foreignKeys {
+		if downTables[fk.TableName] && downTables[fk.ReferencedTableName] && rootWheres[fk.TableName] == "" {
+			downEdges[fk.TableName] = append(downEdges[fk.TableName], subsetEdge{fk: fk, tableName: fk.ReferencedTableName})
+		}
+		if closureTables[fk.TableName] && closureTables[fk.ReferencedTableName] {
+			upEdges[fk.ReferencedTableName] = append(upEdges[fk.ReferencedTableName], subsetEdge{fk: fk, tableName: fk.TableName})
+		}
+	}
+
+	downOrder, downEdges := sortSubsetTables(downTables, downEdges)
+	upOrder, upEdges := sortSubsetTables(closureTables, upEdges)
+
+	ctes := make(map[string]*subsetCTE, len(downOrder)+len(upOrder))
+	var cteOrder []string
+	downCTENames := make(map[string]string, len(downOrder))
+	downPredicates := make(map[string]string, len(downOrder))
+	for i, tableName := range downOrder {
+		cte := &subsetCTE{name: fmt.Sprintf("subset_down_%d", i)}
+		var predicates []string
+		if where, ok := rootWheres[tableName]; ok {
+			predicates = append(predicates, "("+where+")")
+		}
+		for _, e := range downEdges[tableName] {
+			predicates = append(predicates, fmt.Sprintf("(%s) in (select %s from %s)",
+				strings.Join(e.fk.ColumnNames, ", "),
+				strings.Join(e.fk.ReferencedColumnNames, ", "),
+				downCTENames[e.tableName],
+			))
+			cte.deps = append(cte.deps, downCTENames[e.tableName])
+		}
+		if len(predicates) == 0 {
+			// Every foreign key leading to this table was dropped to break a cycle.
+			predicates = append(predicates, "false")
+		}
+		downPredicates[tableName] = strings.Join(predicates, " or ")
+		cte.sql = fmt.Sprintf("select * from %s where %s", tableName, downPredicates[tableName])
+		downCTENames[tableName] = cte.name
+		ctes[cte.name] = cte
+		cteOrder = append(cteOrder, cte.name)
+	}
+
+	upCTENames := make(map[string]string, len(upOrder))
+	for i, tableName := range upOrder {
+		cte := &subsetCTE{name: fmt.Sprintf("subset_%d", i)}
+		var predicates []string
+		if predicate, ok := downPredicates[tableName]; ok {
+			predicates = append(predicates, predicate)
+			cte.deps = append(cte.deps, ctes[downCTENames[tableName]].deps...)
+		}
+		for _, e := range upEdges[tableName] {
+			predicates = append(predicates, fmt.Sprintf("(%s) in (select %s from %s)",
+				strings.Join(e.fk.ReferencedColumnNames, ", "),
+				strings.Join(e.fk.ColumnNames, ", "),
+				upCTENames[e.tableName],
+			))
+			cte.deps = append(cte.deps, upCTENames[e.tableName])
+		}
+		if len(predicates) == 0 {
+			predicates = append(predicates, "false")
+		}
+		cte.sql = fmt.Sprintf("select * from %s where %s", tableName, strings.Join(predicates, " or "))
+		upCTENames[tableName] = cte.name
+		ctes[cte.name] = cte
+		cteOrder = append(cteOrder, cte.name)
+	}
+
+	selectSQL := func(tableName string) string {
+		needed := make(map[string]bool)
+		var visit func(name string)
+		visit = func(name string) {
+			if needed[name] {
+				return
+			}
+			needed[name] = true
+			for _, dep := range ctes[name].deps {
+				visit(dep)
+			}
+		}
+		visit(upCTENames[tableName])
+
+		sb := &strings.Builder{}
+		sb.WriteString("with ")
+		first := true
+		for _, name := range cteOrder {
+			if !needed[name] {
+				continue
+			}
+			if !first {
+				sb.WriteString(",\n  ")
+			}
+			first = false
+			fmt.Fprintf(sb, "%s as (%s)", name, ctes[name].sql)
+		}
+		fmt.Fprintf(sb, "\nselect * from %s", upCTENames[tableName])
+		return sb.String()
+	}
+
+	expandedSteps := make([]*Step, 0, len(steps)+len(closureTables))
+	for _, step := range steps {
+		if step.Where != "" {
+			step.SelectSQL = selectSQL(stepTableNames[step])
+		}
+		expandedSteps = append(expandedSteps, step)
+	}
+
+	generatedTables := make([]string, 0, len(closureTables))
+	for tableName := range closureTables {
+		if !configuredTables[tableName] {
+			generatedTables = append(generatedTables, tableName)
+		}
+	}
+	slices.Sort(generatedTables)
+	for _, tableName := range generatedTables {
+		expandedSteps = append(expandedSteps, &Step{TableName: tableName, SelectSQL: selectSQL(tableName), generated: true})
+		slog.Info("Generated subset step", "table_name", tableName)
+	}
+
+	return expandedSteps, nil
+}
+
+func sortSubsetTables(tables map[string]bool, edges map[string][]subsetEdge) ([]string, map[string][]subsetEdge) {
+	tableNames := make([]string, 0, len(tables))
+	for tableName := range tables {
+		tableNames = append(tableNames, tableName)
+	}
+	slices.Sort(tableNames)
+
+	const visiting, visited = 1, 2
+	state := make(map[string]int, len(tableNames))
+	order := make([]string, 0, len(tableNames))
+	keptEdges := make(map[string][]subsetEdge, len(edges))
+
+	var visit func(tableName string)
+	visit = func(tableName string) {
+		state[tableName] = visiting
+		for _, e := range edges[tableName] {
+			if state[e.tableName] == visiting {
+				slog.Warn("Not following foreign key in subset because it forms a cycle", "table_name", e.fk.TableName, "constraint", e.fk.Name)
+				continue
+			}
+			if state[e.tableName] == 0 {
+				visit(e.tableName)
+			}
+			keptEdges[tableName] = append(keptEdges[tableName], e)
+		}
+		state[tableName] = visited
+		order = append(order, tableName)
+	}
+
+	for _, tableName := range tableNames {
+		if state[tableName] == 0 {
+			visit(tableName)
+		}
+	}
+
+	return order, keptEdges
+}
+
+func resolveTableName(ctx context.Context, conn *pgconn.PgConn, tableName string) (string, error) {
+	result := conn.ExecParams(ctx, "select to_regclass($1)::text", [][]byte{[]byte(tableName)}, nil, nil, nil).Read()
+	if result.Err != nil {
+		return "", fmt.Errorf("error resolving table name %s: %w", tableName, result.Err)
+	}
+
+	return string(result.Rows[0][0]), nil
+}
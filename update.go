@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func updateConfigFile(ctx context.Context, configFilePath string, config *Config, omitSelectSQL, commentOut bool) error {
+	original, err := os.ReadFile(configFilePath)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+
+	sourceConn, err := pgx.Connect(ctx, config.Source.DatabaseURL)
+	if err != nil {
+		return fmt.Errorf("error connecting to source database: %w", err)
+	}
+	defer sourceConn.Close(ctx)
+
+	if config.Source.BeforeTransactionSQL != "" {
+		err := sourceConn.PgConn().Exec(ctx, config.Source.BeforeTransactionSQL).Close()
+		if err != nil {
+			return fmt.Errorf("error executing before transaction SQL: %w", err)
+		}
+	}
+
+	steps, err := expandSubsetSteps(ctx, sourceConn.PgConn(), config.Steps)
+	if err != nil {
+		return fmt.Errorf("error expanding subset steps: %w", err)
+	}
+
+	d, err := findDrift(ctx, config, sourceConn.PgConn(), steps)
+	if err != nil {
+		return fmt.Errorf("error detecting drift: %w", err)
+	}
+
+	generatedSteps, err := generateSteps(ctx, sourceConn, false)
+	if err != nil {
+		return err
+	}
+	generatedStepsByTableName := make(map[string]*Step, len(generatedSteps))
+	for _, step := range generatedSteps {
+		tableName, err := resolveTableName(ctx, sourceConn.PgConn(), step.TableName)
+		if err != nil {
+			return err
+		}
+		generatedStepsByTableName[tableName] = step
+	}
+
+	buf := &bytes.Buffer{}
+	if len(original) > 0 && !bytes.HasSuffix(original, []byte("\n\n")) {
+		if !bytes.HasSuffix(original, []byte("\n")) {
+			buf.WriteString("\n")
+		}
+		buf.WriteString("\n")
+	}
+	separatorLen := buf.Len()
+
+	appendStanza := func(stanza string) bool {
+		if bytes.Contains(original, []byte(stanza)) {
+			return false
+		}
+		buf.WriteString(stanza)
+		buf.WriteString("\n")
+		return true
+	}
+
+	addedStepCount := 0
+	for _, tableName := range d.UncopiedTableNames {
+		step := generatedStepsByTableName[tableName]
+		if step == nil {
+			continue
+		}
+		if omitSelectSQL {
+			step = &Step{TableName: step.TableName}
+		}
+
+		stanza, err := renderStepConfig(step)
+		if err != nil {
+			return err
+		}
+		if commentOut {
+			stanza = commentOutConfig(stanza)
+		}
+		if appendStanza(stanza) {
+			addedStepCount++
+		}
+	}
+
+	for _, sd := range d.Steps {
+		if len(sd.UnmentionedColumnNames) == 0 {
+			continue
+		}
+		tableName, err := resolveTableName(ctx, sourceConn.PgConn(), sd.TableName)
+		if err != nil {
+			return err
+		}
+		step := generatedStepsByTableName[tableName]
+		if step == nil {
+			continue
+		}
+
+		stanza, err := renderStepConfig(step)
+		if err != nil {
+			return err
+		}
+		appendStanza(fmt.Sprintf("# select_sql of step %d (%s) does not mention %s. The table now has these columns:\n%s",
+			sd.Index, sd.TableName, strings.Join(sd.UnmentionedColumnNames, ", "), commentOutConfig(stanza),
+		))
+	}
+
+	if buf.Len() == separatorLen {
+		slog.Info("Config file is up to date")
+		return nil
+	}
+
+	file, err := os.OpenFile(configFilePath, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("error opening config file: %w", err)
+	}
+
+	_, err = file.Write(buf.Bytes())
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("error writing config file: %w", err)
+	}
+
+	slog.Info("Updated config file", "steps", addedStepCount)
+
+	return nil
+}
+
+func renderStepConfig(step *Step) (string, error) {
+	sb := &strings.Builder{}
+	err := stepConfigTemplate.Execute(sb, step)
+	if err != nil {
+		return "", fmt.Errorf("error rendering step: %w", err)
+	}
+	return sb.String(), nil
+}
+
+func commentOutConfig(s string) string {
+	sb := &strings.Builder{}
+	for line := range strings.Lines(s) {
+		if line != "\n" {
+			sb.WriteString("# ")
+		}
+		sb.WriteString(line)
+	}
+	return sb.String()
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func validateConfig(ctx context.Context, config *Config) ([]string, error) {
+	var problems []string
+	addProblem := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	stepName := func(i int, step *Step) string {
+		return fmt.Sprintf("step %d (%s)", i, step.TableName)
+	}
+
+	for _, key := range config.undecodedKeys {
+		addProblem("unknown key %s", key)
+	}
+
+	if config.Source.DatabaseURL == "" {
+		addProblem("source.database_url is required")
+	}
+	if err := config.validateDestination(); err != nil {
+		addProblem("%v", err)
+	}
+	if len(config.Steps) == 0 {
+		addProblem("no steps")
+	}
+	if err := config.validateParallelism(); err != nil {
+		addProblem("%v", err)
+	}
+	if err := config.validateRefresh(); err != nil {
+		addProblem("%v", err)
+	}
+	if err := config.validateOnFKViolation(); err != nil {
+		addProblem("%v", err)
+	}
+	if err := config.validateVerify(); err != nil {
+		addProblem("%v", err)
+	}
+	if _, err := config.Masking.engine(); err != nil {
+		addProblem("%v", err)
+	}
+
+	stepsByTableName := make(map[string]int)
+	for i, step := range config.Steps {
+		if step.TableName == "" {
+			addProblem("step %d: table_name is required", i)
+		} else if prevIdx, present := stepsByTableName[step.TableName]; present {
+			addProblem("%s: same table as step %d", stepName(i, step), prevIdx)
+		} else {
+			stepsByTableName[step.TableName] = i
+		}
+
+		if strings.HasSuffix(strings.TrimSpace(step.SelectSQL), ";") {
+			addProblem("%s: select_sql must not end with a semicolon", stepName(i, step))
+		}
+
+		if err := step.validateChunking(); err != nil {
+			addProblem("%s: %v", stepName(i, step), err)
+		}
+	}
+
+	if config.Source.DatabaseURL == "" {
+		return problems, nil
+	}
+
+	sourceConn, err := connectSourceForInspection(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	defer sourceConn.Close(ctx)
+
+	var destinationConn *pgconn.PgConn
+	if (config.Destination.Type == "" || config.Destination.Type == "database") && config.Destination.DatabaseURL != "" {
+		destinationConn, err = pgconn.Connect(ctx, config.Destination.DatabaseURL)
+		if err != nil {
+			// destination.prepare_command may create the destination.
+			slog.Warn("Unable to connect to destination, skipping destination checks", "error", err)
+			destinationConn = nil
+		} else {
+			defer destinationConn.Close(ctx)
+		}
+	}
+
+	steps, err := expandSubsetSteps(ctx, sourceConn, config.Steps)
+	if err != nil {
+		addProblem("%v", err)
+		return problems, nil
+	}
+
+	for i, step := range steps {
+		if step.TableName == "" {
+			continue
+		}
+
+		// Rolling back to a savepoint after each step allows checking the remaining steps after a query fails.
+		err := sourceConn.Exec(ctx, "savepoint validate_step").Close()
+		if err != nil {
+			return nil, err
+		}
+
+		problem, err := validateStep(ctx, config, sourceConn, destinationConn, step)
+		if err != nil {
+			return nil, err
+		}
+		if problem != "" {
+			addProblem("%s: %s", stepName(i, step), problem)
+		}
+
+		err = sourceConn.Exec(ctx, "rollback to savepoint validate_step").Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return problems, nil
+}
+
+func validateStep(ctx context.Context, config *Config, sourceConn, destinationConn *pgconn.PgConn, step *Step) (string, error) {
+	tableName, err := resolveTableName(ctx, sourceConn, step.TableName)
+	if err != nil {
+		return "", err
+	}
+	// A step with before_copy_sql may be copying to a table it creates such as a temporary table.
+	if tableName == "" && step.BeforeCopySQL == "" {
+		return "table does not exist in source", nil
+	}
+
+	err = config.Masking.validatePatterns(ctx, sourceConn, step)
+	if err != nil {
+		return err.Error(), nil
+	}
+
+	plan, err := planStepCopy(ctx, config, sourceConn, step)
+	if err != nil {
+		return err.Error(), nil
+	}
+
+	columnNames, err := describeColumnNames(ctx, sourceConn, plan.SelectSQL)
+	if err != nil {
+		return err.Error(), nil
+	}
+
+	if plan.DestinationColumnNames != nil {
+		if len(columnNames) != len(plan.DestinationColumnNames) {
+			return fmt.Sprintf("select_sql returns %d columns but %d columns are copied", len(columnNames), len(plan.DestinationColumnNames)), nil
+		}
+	} else if tableName != "" {
+		tableColumnCount, err := countTableColumns(ctx, sourceConn, tableName)
+		if err != nil {
+			return "", err
+		}
+		if len(columnNames) != tableColumnCount {
+			return fmt.Sprintf("select_sql returns %d columns but source table has %d", len(columnNames), tableColumnCount), nil
+		}
+	}
+
+	if destinationConn == nil {
+		return "", nil
+	}
+	return validateStepDestination(ctx, destinationConn, step, plan, len(columnNames))
+}
+
+func validateStepDestination(ctx context.Context, destinationConn *pgconn.PgConn, step *Step, plan *stepCopyPlan, columnCount int) (string, error) {
+	tableName, err := resolveTableName(ctx, destinationConn, step.TableName)
+	if err != nil || tableName == "" {
+		return "", err
+	}
+
+	columns, err := getTableColumns(ctx, destinationConn, tableName)
+	if err != nil {
+		return "", err
+	}
+
+	if plan.DestinationColumnNames == nil {
+		if columnCount != len(columns) {
+			return fmt.Sprintf("select_sql returns %d columns but destination table has %d", columnCount, len(columns)), nil
+		}
+		return "", nil
+	}
+
+	destinationColumnNames := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		destinationColumnNames[column.Name] = true
+	}
+	for _, name := range plan.DestinationColumnNames {
+		if !destinationColumnNames[unquoteIdentifier(name)] {
+			return fmt.Sprintf("destination table has no column %s", name), nil
+		}
+	}
+
+	return "", nil
+}
+
+func unquoteIdentifier(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return strings.ReplaceAll(s[1:len(s)-1], `""`, `"`)
+	}
+	return strings.ToLower(s)
+}
+
+func countTableColumns(ctx context.Context, conn *pgconn.PgConn, tableName string) (int, error) {
+	result := conn.ExecParams(ctx,
+		"select count(*) from pg_attribute where attrelid = $1::regclass and attnum > 0 and not attisdropped",
+		[][]byte{[]byte(tableName)}, nil, nil, nil,
+	).Read()
+	if result.Err != nil {
+		return 0, fmt.Errorf("error counting columns of %s: %w", tableName, result.Err)
+	}
+
+	return strconv.Atoi(string(result.Rows[0][0]))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+type verificationError struct {
+	msg string
+}
+
+func (e *verificationError) Error() string {
+	return "row count verification failed: " + e.msg
+}
+
+func (config *Config) validateVerify() error {
+	switch config.Verify {
+	case "":
+		return nil
+	case "rows", "count":
+	default:
+		return fmt.Errorf("unknown verify: %s", config.Verify)
+	}
+
+	if config.Destination.Type != "" && config.Destination.Type != "database" {
+		return fmt.Errorf("verify cannot be used with destination.type %s", config.Destination.Type)
+	}
+
+	return nil
+}
+
+func verifyCopiedRows(ctx context.Context, sourceConn *pgconn.PgConn, plan *stepCopyPlan, sourceRows, copiedRows int64) error {
+	if copiedRows != sourceRows {
+		return &verificationError{msg: fmt.Sprintf("%d rows were copied from the source but %d rows were copied to the destination", sourceRows, copiedRows)}
+	}
+
+	if plan.verify != "count" {
+		return nil
+	}
+
+	count, err := countRows(ctx, sourceConn, plan.CountSQL)
+	if err != nil {
+		return fmt.Errorf("error counting rows in source: %w", err)
+	}
+	if count != copiedRows {
+		return &verificationError{msg: fmt.Sprintf("%s returned %d rows but %d rows were copied", plan.CountSQL, count, copiedRows)}
+	}
+
+	return nil
+}
+
+func countRows(ctx context.Context, conn *pgconn.PgConn, countSQL string) (int64, error) {
+	result := conn.ExecParams(ctx, countSQL, nil, nil, nil, nil).Read()
+	if result.Err != nil {
+		return 0, result.Err
+	}
+	return strconv.ParseInt(string(result.Rows[0][0]), 10, 64)
+}
+
+func executeAfterCopySQL(ctx context.Context, config *Config, destinationConn *pgconn.PgConn, step *Step) error {
+	if config.Verify == "" {
+		return destinationConn.Exec(ctx, step.AfterCopySQL).Close()
+	}
+
+	countSQL := fmt.Sprintf("select count(*) from %s", step.TableName)
+	before, err := countRows(ctx, destinationConn, countSQL)
+	if err != nil {
+		return fmt.Errorf("error counting rows in destination: %w", err)
+	}
+
+	err = destinationConn.Exec(ctx, step.AfterCopySQL).Close()
+	if err != nil {
+		return err
+	}
+
+	exists, err := tableExists(ctx, destinationConn, step.TableName)
+	if err != nil || !exists {
+		return err
+	}
+
+	after, err := countRows(ctx, destinationConn, countSQL)
+	if err != nil {
+		return fmt.Errorf("error counting rows in destination: %w", err)
+	}
+
+	if removed := before - after; removed > 0 {
+		step.progress.recordAfterCopySQLRemovedRows(removed)
+		slog.Warn("after_copy_sql removed copied rows", "table_name", step.TableName, "rows", removed)
+	}
+
+	return nil
+}
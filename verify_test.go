@@ -0,0 +1,19 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyCopiedRows(t *testing.T) {
+	plan := &stepCopyPlan{verify: "rows"}
+
+	err := verifyCopiedRows(t.Context(), nil, plan, 3, 3)
+	require.NoError(t, err)
+
+	err = verifyCopiedRows(t.Context(), nil, plan, 3, 2)
+	var verr *verificationError
+	require.ErrorAs(t, err, &verr)
+	require.EqualError(t, err, "row count verification failed: 3 rows were copied from the source but 2 rows were copied to the destination")
+}